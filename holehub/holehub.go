@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/Lupino/hole"
 	"github.com/codegangsta/cli"
@@ -9,6 +10,8 @@ import (
 	"github.com/xyproto/simplebolt"
 	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -26,6 +29,7 @@ var defaultReTryTime = 1000
 var reTryTimes = defaultReTryTime
 
 var hubHost string
+var hubOrg string
 var cookie string
 
 var boltFile = os.Getenv("HOME") + "/.holehub.db"
@@ -126,6 +130,7 @@ func Ping() bool {
 
 type HoleApp struct {
 	ID      string
+	Org     string
 	Name    string
 	Port    string
 	Host    string
@@ -151,6 +156,7 @@ func NewHoleApp(ID string) (holeApp HoleApp, err error) {
 	holeApp.Lhost, _ = holes.Get(ID, "local-host")
 	holeApp.Lscheme, _ = holes.Get(ID, "local-scheme")
 	holeApp.Status, _ = holes.Get(ID, "status")
+	holeApp.Org, _ = holes.Get(ID, "org")
 
 	if holeApp.Status == "started" {
 		Pid, _ := holes.Get(ID, "pid")
@@ -160,24 +166,49 @@ func NewHoleApp(ID string) (holeApp HoleApp, err error) {
 	return holeApp, nil
 }
 
+// appNameKey is the key of a hole name in appnames. Personal holes keep
+// the bare name, the holes of an organization are kept apart under it.
+func appNameKey(org, name string) string {
+	if org == "" {
+		return name
+	}
+	return "org:" + org + "/" + name
+}
+
+// NewHoleAppByName returns the local hole called name of --org, or of the
+// user without it.
 func NewHoleAppByName(name string) (holeApp HoleApp, err error) {
-	holeID, _ := appNames.Get(name)
+	key := appNameKey(hubOrg, name)
+	holeID, _ := appNames.Get(key)
 	if holeID == "" {
 		err = fmt.Errorf("hole app: not exists.")
 		return
 	}
 	if holeApp, err = NewHoleApp(holeID); err != nil {
-		appNames.Del(name)
+		appNames.Del(key)
+		return
+	}
+	if holeApp.Org != hubOrg || holeApp.Name != name {
+		err = fmt.Errorf("hole app: not exists.")
 	}
 	return
 }
 
+// apiPath returns the api prefix of the holes of org, or of the user when
+// org is empty.
+func apiPath(org string) string {
+	if org == "" {
+		return hubHost + "/api"
+	}
+	return hubHost + "/api/orgs/" + org
+}
+
 func (hole HoleApp) run(command string) {
 	var ro = &grequests.RequestOptions{
 		Headers: map[string]string{"Cookie": cookie},
 	}
 
-	rsp, err := grequests.Post(hubHost+"/api/holes/"+hole.ID+"/"+command+"/", ro)
+	rsp, err := grequests.Post(apiPath(hole.Org)+"/holes/"+hole.ID+"/"+command+"/", ro)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -223,56 +254,125 @@ func (hole HoleApp) Remove() {
 	}
 	holes.Del(hole.ID)
 	apps.Del(hole.ID)
-	appNames.Del(hole.Name)
+	key := appNameKey(hole.Org, hole.Name)
+	if holeID, _ := appNames.Get(key); holeID == hole.ID {
+		appNames.Del(key)
+	}
 	hole.run("remove")
 }
 
+// createHoleApp creates a hole on the server, which refuses a name already
+// used by another hole of the user or org.
 func createHoleApp(scheme, name string) HoleApp {
-	if has, _ := appNames.Get(name); has != "" {
-		log.Fatalf("App Name: %s is already exists. bind on %s\n", name, has)
-	}
 	var ro = &grequests.RequestOptions{
 		Headers: map[string]string{"Cookie": cookie},
 		Data:    map[string]string{"scheme": scheme, "name": name},
 	}
 
-	rsp, err := grequests.Post(hubHost+"/api/holes/create/", ro)
+	rsp, err := grequests.Post(apiPath(hubOrg)+"/holes/create/", ro)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer rsp.Close()
 
-	if !rsp.Ok {
+	if !rsp.Ok && rsp.StatusCode != http.StatusConflict {
 		log.Fatalf("Error: %s\n", rsp.String())
 	}
 
-	var msg map[string]HoleApp
+	var msg map[string]json.RawMessage
 	err = rsp.JSON(&msg)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	hole := msg["hole"]
+	if _, ok := msg["code"]; ok {
+		var je JE
+		data, _ := json.Marshal(msg)
+		json.Unmarshal(data, &je)
+		fmt.Printf("Error: %s %s\n", je.Error, je.Message)
+		os.Exit(1)
+	}
+
+	var hole HoleApp
+	if err = json.Unmarshal(msg["hole"], &hole); err != nil {
+		log.Fatal(err)
+	}
+	hole.Org = hubOrg
+	saveHoleApp(hole)
+	holes.Set(hole.ID, "status", "stoped")
+
+	return hole
+}
+
+// saveHoleApp stores a hole from the server in the local database.
+func saveHoleApp(hole HoleApp) {
 	holes.Set(hole.ID, "name", hole.Name)
+	holes.Set(hole.ID, "org", hole.Org)
 	holes.Set(hole.ID, "scheme", hole.Scheme)
 	holes.Set(hole.ID, "host", hole.Host)
 	holes.Set(hole.ID, "port", hole.Port)
-	holes.Set(hole.ID, "status", "stoped")
 	apps.Add(hole.ID)
 	if hole.Name != "" {
-		appNames.Set(hole.Name, hole.ID)
+		appNames.Set(appNameKey(hole.Org, hole.Name), hole.ID)
 	}
+}
 
-	return hole
+// fetchHoleApp loads a hole the local database does not know from the
+// server, so holes created on another machine or by another member of an
+// organization can be used here.
+func fetchHoleApp(holeID string) (HoleApp, error) {
+	return fetchHole(apiPath(hubOrg) + "/holes/" + holeID + "/")
 }
 
-func getCert(name, outName string) {
+// fetchHoleAppByName gets the hole called name from the server, so a name
+// resolves on any machine.
+func fetchHoleAppByName(name string) (HoleApp, error) {
+	return fetchHole(apiPath(hubOrg) + "/holes/by-name/" + url.PathEscape(name))
+}
+
+func fetchHole(holeURL string) (holeApp HoleApp, err error) {
+	if !Ping() {
+		Login()
+	}
+
 	var ro = &grequests.RequestOptions{
 		Headers: map[string]string{"Cookie": cookie},
 	}
 
-	rsp, err := grequests.Get(hubHost+"/api/"+name, ro)
+	rsp, err := grequests.Get(holeURL, ro)
+	if err != nil {
+		return
+	}
+	defer rsp.Close()
+
+	if rsp.StatusCode == http.StatusConflict {
+		var je JE
+		rsp.JSON(&je)
+		err = fmt.Errorf("%s %s", je.Error, je.Message)
+		return
+	}
+	if !rsp.Ok {
+		err = fmt.Errorf("hole app: not exists.")
+		return
+	}
+
+	if err = rsp.JSON(&holeApp); err != nil {
+		return
+	}
+	holeApp.Org = hubOrg
+	holeApp.Status = "stoped"
+	saveHoleApp(holeApp)
+	holes.Set(holeApp.ID, "status", holeApp.Status)
+	return holeApp, nil
+}
+
+func getCert(org, name, outName string) {
+	var ro = &grequests.RequestOptions{
+		Headers: map[string]string{"Cookie": cookie},
+	}
+
+	rsp, err := grequests.Get(apiPath(org)+"/"+name, ro)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -288,8 +388,8 @@ func getCert(name, outName string) {
 }
 
 func processHoleClient(holeApp HoleApp, restart bool) {
-	getCert("cert.pem", certFile)
-	getCert("cert.key", privFile)
+	getCert(holeApp.Org, "cert.pem", certFile)
+	getCert(holeApp.Org, "cert.key", privFile)
 
 	var realAddr = holeApp.Lscheme + "://" + holeApp.Lhost + ":" + holeApp.Lport
 	var serverAddr = holeApp.Scheme + "://" + holeApp.Host + ":" + holeApp.Port
@@ -315,6 +415,28 @@ func processHoleClient(holeApp HoleApp, restart bool) {
 
 }
 
+var heartbeatInterval = 30 * time.Second
+
+// heartbeat tells the server the client of the hole is alive until the
+// process exits.
+func heartbeat(holeApp HoleApp) {
+	var ro = &grequests.RequestOptions{
+		Headers: map[string]string{"Cookie": cookie},
+	}
+	for {
+		rsp, err := grequests.Post(apiPath(holeApp.Org)+"/holes/"+holeApp.ID+"/heartbeat/", ro)
+		if err != nil {
+			log.Printf("Heartbeat: %s\n", err)
+		} else {
+			if !rsp.Ok {
+				log.Printf("Heartbeat: %s\n", rsp.String())
+			}
+			rsp.Close()
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
+
 func Run(name, scheme, lhost, lport string, rm, restart bool) {
 	if !Ping() {
 		Login()
@@ -335,21 +457,74 @@ func Run(name, scheme, lhost, lport string, rm, restart bool) {
 	}
 
 	go processHoleClient(holeApp, restart)
+	go heartbeat(holeApp)
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, os.Interrupt, os.Kill)
 	<-s
 }
 
+type StatsBucket struct {
+	Time     int64 `json:"time"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+var throughputWindow int64 = 300
+
+func formatRate(bytes int64) string {
+	rate := float64(bytes) / float64(throughputWindow)
+	units := []string{"B/s", "KB/s", "MB/s", "GB/s"}
+	i := 0
+	for rate >= 1024 && i < len(units)-1 {
+		rate /= 1024
+		i++
+	}
+	return strconv.FormatFloat(rate, 'f', 1, 64) + units[i]
+}
+
+// throughput returns the average rate of the hole over the last five
+// minutes, or - when the server does not answer.
+func throughput(hole HoleApp) string {
+	var ro = &grequests.RequestOptions{
+		Headers: map[string]string{"Cookie": cookie},
+		Params: map[string]string{
+			"step": "minute",
+			"from": strconv.FormatInt(time.Now().Unix()-throughputWindow, 10),
+		},
+	}
+
+	rsp, err := grequests.Get(apiPath(hole.Org)+"/holes/"+hole.ID+"/stats", ro)
+	if err != nil {
+		return "-"
+	}
+	defer rsp.Close()
+
+	var stats struct {
+		Stats []StatsBucket `json:"stats"`
+	}
+	if !rsp.Ok || rsp.JSON(&stats) != nil {
+		return "-"
+	}
+
+	var in, out int64
+	for _, bucket := range stats.Stats {
+		in += bucket.BytesIn
+		out += bucket.BytesOut
+	}
+	return formatRate(in) + " in " + formatRate(out) + " out"
+}
+
 func ListApp() {
 	holeIDs, _ := apps.GetAll()
-	fmt.Println("ID\t\t\t\t\tName\t\tPort\t\t\t\t\tStatus")
+	fmt.Println("ID\t\t\t\t\tName\t\tPort\t\t\t\t\tStatus\tThroughput")
 	for _, holeID := range holeIDs {
 		holeApp, err := NewHoleApp(holeID)
 		if err != nil {
 			continue
 		}
-		fmt.Printf("%s\t%s\t\t%s:%s/%s->%s:%s/%s\t%s\n", holeApp.ID,
-			holeApp.Name, holeApp.Lhost, holeApp.Lport, holeApp.Lscheme, holeApp.Host, holeApp.Port, holeApp.Scheme, holeApp.Status)
+		fmt.Printf("%s\t%s\t\t%s:%s/%s->%s:%s/%s\t%s\t%s\n", holeApp.ID,
+			holeApp.Name, holeApp.Lhost, holeApp.Lport, holeApp.Lscheme, holeApp.Host, holeApp.Port, holeApp.Scheme, holeApp.Status,
+			throughput(holeApp))
 	}
 }
 
@@ -362,7 +537,7 @@ func ListServerApp() {
 		Headers: map[string]string{"Cookie": cookie},
 	}
 
-	rsp, err := grequests.Get(hubHost+"/api/holes/", ro)
+	rsp, err := grequests.Get(apiPath(hubOrg)+"/holes/", ro)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -376,33 +551,58 @@ func ListServerApp() {
 
 	err = rsp.JSON(&holeApps)
 
-	fmt.Println("ID\t\t\t\t\tName\t\tPort\t\t\t\t\tStatus")
+	fmt.Println("ID\t\t\t\t\tName\t\tPort\t\t\t\t\tStatus\tThroughput")
 	var holeApp, rh HoleApp
 	for _, rh = range holeApps["holes"] {
 		holeApp, err = NewHoleApp(rh.ID)
 		if err != nil {
 			holeApp = rh
 		}
-		fmt.Printf("%s\t%s\t\t%s:%s/%s->%s:%s/%s\t%s\n", holeApp.ID,
-			holeApp.Name, holeApp.Lhost, holeApp.Lport, holeApp.Lscheme, holeApp.Host, holeApp.Port, holeApp.Scheme, holeApp.Status)
+		fmt.Printf("%s\t%s\t\t%s:%s/%s->%s:%s/%s\t%s\t%s\n", holeApp.ID,
+			holeApp.Name, holeApp.Lhost, holeApp.Lport, holeApp.Lscheme, holeApp.Host, holeApp.Port, holeApp.Scheme, holeApp.Status,
+			throughput(holeApp))
 	}
 }
 
-func StartApp(nameOrID string, restart bool) {
+// findHoleApp looks nameOrID up in the local database, then on the server
+// by name and by ID.
+func findHoleApp(nameOrID string) HoleApp {
 	var holeApp HoleApp
 	var err error
-	if holeApp, err = NewHoleAppByName(nameOrID); err != nil {
-		if holeApp, err = NewHoleApp(nameOrID); err != nil {
-			log.Fatal(err)
-		}
+	if holeApp, err = NewHoleAppByName(nameOrID); err == nil {
+		return holeApp
+	}
+	if holeApp, err = NewHoleApp(nameOrID); err == nil {
+		return holeApp
+	}
+	if holeApp, err = fetchHoleAppByName(nameOrID); err == nil {
+		return holeApp
+	}
+	byNameErr := err
+	if holeApp, err = fetchHoleApp(nameOrID); err != nil {
+		log.Fatal(byNameErr)
 	}
+	return holeApp
+}
+
+func StartApp(nameOrID, lhost, lport string, restart bool) {
+	holeApp := findHoleApp(nameOrID)
 	if holeApp.Status == "started" {
 		log.Fatalf("HoleApp: %s is already started.", nameOrID)
 	}
+	if holeApp.Lport == "" {
+		holes.Set(holeApp.ID, "local-port", lport)
+		holes.Set(holeApp.ID, "local-host", lhost)
+		holes.Set(holeApp.ID, "local-scheme", holeApp.Scheme)
+		holeApp.Lport = lport
+		holeApp.Lhost = lhost
+		holeApp.Lscheme = holeApp.Scheme
+	}
 
 	holeApp.Start()
 	defer holeApp.Kill()
 	go processHoleClient(holeApp, restart)
+	go heartbeat(holeApp)
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, os.Interrupt, os.Kill)
 	<-s
@@ -411,12 +611,14 @@ func StartApp(nameOrID string, restart bool) {
 func StopApp(nameOrID string, kill bool) {
 	var holeApp HoleApp
 	var err error
-	if holeApp, err = NewHoleAppByName(nameOrID); err != nil {
+	if kill {
+		holeApp = findHoleApp(nameOrID)
+	} else if holeApp, err = NewHoleAppByName(nameOrID); err != nil {
 		if holeApp, err = NewHoleApp(nameOrID); err != nil {
 			log.Fatal(err)
 		}
 	}
-	if holeApp.Status == "stoped" {
+	if holeApp.Status == "stoped" && !kill {
 		log.Fatalf("HoleApp: %s is already stoped.", nameOrID)
 	}
 
@@ -424,17 +626,13 @@ func StopApp(nameOrID string, kill bool) {
 		holeApp.Kill()
 	}
 
-	killApp(holeApp.Pid)
+	if holeApp.Status == "started" {
+		killApp(holeApp.Pid)
+	}
 }
 
 func RemoveApp(nameOrID string) {
-	var holeApp HoleApp
-	var err error
-	if holeApp, err = NewHoleAppByName(nameOrID); err != nil {
-		if holeApp, err = NewHoleApp(nameOrID); err != nil {
-			log.Fatal(err)
-		}
-	}
+	holeApp := findHoleApp(nameOrID)
 	if holeApp.Status == "started" {
 		killApp(holeApp.Pid)
 	}
@@ -442,6 +640,137 @@ func RemoveApp(nameOrID string) {
 	holeApp.Remove()
 }
 
+type ConnectionEntry struct {
+	Remote    string `json:"remote"`
+	StartedAt int64  `json:"started_at"`
+	EndedAt   int64  `json:"ended_at"`
+	BytesIn   int64  `json:"bytes_in"`
+	BytesOut  int64  `json:"bytes_out"`
+	Reason    string `json:"reason"`
+}
+
+func ListConnections(nameOrID string) {
+	holeApp := findHoleApp(nameOrID)
+	if !Ping() {
+		Login()
+	}
+
+	var ro = &grequests.RequestOptions{
+		Headers: map[string]string{"Cookie": cookie},
+	}
+
+	rsp, err := grequests.Get(apiPath(holeApp.Org)+"/holes/"+holeApp.ID+"/connections", ro)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rsp.Close()
+
+	if !rsp.Ok {
+		log.Fatalf("Error: %s\n", rsp.String())
+	}
+
+	var connections map[string][]ConnectionEntry
+	if err = rsp.JSON(&connections); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Remote\t\t\tStarted\t\t\tDuration\tIn\tOut\tReason")
+	for _, conn := range connections["connections"] {
+		fmt.Printf("%s\t%s\t%ds\t\t%d\t%d\t%s\n", conn.Remote,
+			time.Unix(conn.StartedAt, 0).Format("2006-01-02 15:04:05"), conn.EndedAt-conn.StartedAt,
+			conn.BytesIn, conn.BytesOut, conn.Reason)
+	}
+}
+
+type Event struct {
+	Type  string                 `json:"type"`
+	Hole  string                 `json:"hole"`
+	Owner string                 `json:"owner"`
+	Time  int64                  `json:"time"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// TailEvents prints the events of the user's holes, or of one hole when
+// nameOrID is set, as they come.
+func TailEvents(nameOrID string) {
+	var params = map[string]string{}
+	if nameOrID != "" {
+		params["hole"] = findHoleApp(nameOrID).ID
+	}
+	if !Ping() {
+		Login()
+	}
+
+	var ro = &grequests.RequestOptions{
+		Headers: map[string]string{"Cookie": cookie, "Accept": "text/event-stream"},
+		Params:  params,
+	}
+
+	rsp, err := grequests.Get(hubHost+"/api/events", ro)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rsp.Close()
+
+	if !rsp.Ok {
+		log.Fatalf("Error: %s\n", rsp.String())
+	}
+
+	var event Event
+	scanner := bufio.NewScanner(rsp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 6 || line[:6] != "data: " {
+			continue
+		}
+		if err = json.Unmarshal([]byte(line[6:]), &event); err != nil {
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s", time.Unix(event.Time, 0).Format("2006-01-02 15:04:05"), event.Hole, event.Type)
+		for key, value := range event.Data {
+			fmt.Printf("\t%s=%v", key, value)
+		}
+		fmt.Println()
+	}
+	if err = scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// SetPolicy sets what the server does with the hole when its client stops
+// sending heartbeats.
+func SetPolicy(nameOrID, onDisconnect, grace string) {
+	holeApp := findHoleApp(nameOrID)
+	if !Ping() {
+		Login()
+	}
+
+	var ro = &grequests.RequestOptions{
+		Headers: map[string]string{"Cookie": cookie},
+		Data:    map[string]string{"on_disconnect": onDisconnect, "grace": grace},
+	}
+
+	rsp, err := grequests.Post(apiPath(holeApp.Org)+"/holes/"+holeApp.ID+"/policy/", ro)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rsp.Close()
+
+	if !rsp.Ok {
+		log.Fatalf("Error: %s\n", rsp.String())
+	}
+
+	var result map[string]interface{}
+	if err = rsp.JSON(&result); err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := result["code"]; ok {
+		fmt.Printf("Error: %s\n", result["error"])
+		return
+	}
+	fmt.Printf("on_disconnect: %v\tgrace: %vs\n", result["OnDisconnect"], result["Grace"])
+}
+
 func ReadLine(rdr *bufio.Scanner, prompt string) string {
 	var text string
 	for len(text) == 0 {
@@ -465,6 +794,12 @@ func main() {
 			Usage:  "The HoleHUB Host",
 			EnvVar: "HOLEHUB_HOST",
 		},
+		cli.StringFlag{
+			Name:   "org, o",
+			Value:  "",
+			Usage:  "Work on the holes of an organization",
+			EnvVar: "HOLEHUB_ORG",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -544,6 +879,7 @@ func main() {
 				var rm = c.Bool("rm")
 				var restart = c.Bool("restart")
 				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
 				Run(name, scheme, host, port, rm, restart)
 			},
 		},
@@ -558,6 +894,7 @@ func main() {
 			},
 			Action: func(c *cli.Context) {
 				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
 				if c.Bool("all") {
 					ListServerApp()
 
@@ -575,6 +912,16 @@ func main() {
 					Name:  "restart",
 					Usage: "Auto restart the crash.",
 				},
+				cli.StringFlag{
+					Name:  "local_host, lh",
+					Value: "127.0.0.1",
+					Usage: "The source server host, for holes created elsewhere.",
+				},
+				cli.StringFlag{
+					Name:  "local_port, lp",
+					Value: "8080",
+					Usage: "The source server port, for holes created elsewhere.",
+				},
 			},
 			Action: func(c *cli.Context) {
 				if len(c.Args()) == 0 {
@@ -583,8 +930,9 @@ func main() {
 					os.Exit(1)
 				}
 				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
 				var restart = c.Bool("restart")
-				StartApp(c.Args().First(), restart)
+				StartApp(c.Args().First(), c.String("local_host"), c.String("local_port"), restart)
 			},
 		},
 		{
@@ -611,6 +959,7 @@ func main() {
 					os.Exit(1)
 				}
 				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
 				StopApp(c.Args().First(), true)
 			},
 		},
@@ -625,9 +974,60 @@ func main() {
 					os.Exit(1)
 				}
 				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
 				RemoveApp(c.Args().First())
 			},
 		},
+		{
+			Name:        "connections",
+			Usage:       "list the latest public connections of a HoleApp",
+			Description: "connections name\n   connections ID",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					fmt.Printf("Not enough arguments.\n\n")
+					cli.ShowCommandHelp(c, "connections")
+					os.Exit(1)
+				}
+				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
+				ListConnections(c.Args().First())
+			},
+		},
+		{
+			Name:        "events",
+			Usage:       "tail the events of the HoleApps",
+			Description: "events\n   events name\n   events ID",
+			Action: func(c *cli.Context) {
+				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
+				TailEvents(c.Args().First())
+			},
+		},
+		{
+			Name:        "policy",
+			Usage:       "set what the server does when the client of a HoleApp is gone",
+			Description: "policy name\n   policy ID",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "on_disconnect",
+					Usage: "keep or kill the hole.",
+				},
+				cli.StringFlag{
+					Name:  "grace",
+					Usage: "seconds without heartbeat before the hole is disconnected.",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					fmt.Printf("Not enough arguments.\n\n")
+					cli.ShowCommandHelp(c, "policy")
+					os.Exit(1)
+				}
+				hubHost = c.GlobalString("host")
+				hubOrg = c.GlobalString("org")
+				SetPolicy(c.Args().First(), c.String("on_disconnect"), c.String("grace"))
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) {
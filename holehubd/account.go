@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var certExpiryDays int
+var certExpiryInterval = 24 * time.Hour
+
+// requestPassword returns the password sent along a DELETE request.
+// net/http only parses the body of POST, PUT and PATCH requests, so the
+// form is read by hand here.
+func requestPassword(req *http.Request) string {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<16))
+	if err != nil {
+		return ""
+	}
+	form, _ := url.ParseQuery(string(body))
+	return form.Get("password")
+}
+
+// CreateAccount adds the user with its certificates. The user still has
+// to be confirmed.
+func CreateAccount(username, password, email string) {
+	userstate.AddUser(username, password, email)
+	emails.Set(email, username)
+	GenerateUserCa(username)
+	GenerateUserCert(username)
+	users := userstate.Users()
+	users.Set(username, "ca", username+"-ca.pem")
+	users.Set(username, "cakey", username+"-ca.key")
+	users.Set(username, "cert", username+"-cert.pem")
+	users.Set(username, "certkey", username+"-cert.key")
+}
+
+// NewPasswordToken creates a password reset token for username that is
+// valid for 12 hours. Only the latest token of a user is remembered.
+func NewPasswordToken(username string) (string, error) {
+	var code string
+	for loop := 0; ; loop++ {
+		if loop > 1000 {
+			return "", fmt.Errorf("Too many loops...")
+		}
+		code, _ = userstate.GenerateUniqueConfirmationCode()
+		if tokenStr, _ := passwordTokens.Get(code); tokenStr == "" {
+			break
+		}
+	}
+	expiredAt := time.Now().Add(12 * time.Hour).Unix()
+	passwordTokens.Set(code, fmt.Sprintf("{\"username\": \"%s\", \"expiredAt\": \"%d\"}", username, expiredAt))
+	userstate.Users().Set(username, "password_token", code)
+	return code, nil
+}
+
+// CheckCertExpiry warns every owner whose certificate expires within
+// certExpiryDays, once per certificate: it publishes a cert_expiring event
+// and mails users.
+func CheckCertExpiry() {
+	deadline := time.Now().AddDate(0, 0, certExpiryDays)
+	for _, owner := range allOwners() {
+		certFile := configPath + "certs/" + certName(owner) + "-cert.pem"
+		data, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			log.Println("parse", certFile, "failed", err)
+			continue
+		}
+		if cert.NotAfter.After(deadline) {
+			continue
+		}
+		notAfter := strconv.FormatInt(cert.NotAfter.Unix(), 10)
+		record, key, _ := usershole.ownerRecord(owner)
+		if notified, _ := record.Get(key, "cert_expiry_notified"); notified == notAfter {
+			continue
+		}
+		record.Set(key, "cert_expiry_notified", notAfter)
+		Publish(Event{
+			Type:  EventCertExpiring,
+			Owner: owner,
+			Time:  time.Now().Unix(),
+			Data:  map[string]interface{}{"not_after": cert.NotAfter.Unix()},
+		})
+		if _, isOrg := orgName(owner); !isOrg {
+			if email, _ := userstate.Email(owner); email != "" {
+				SendCertExpiry(owner, email, cert.NotAfter)
+			}
+		}
+	}
+}
+
+func RunCertExpiryCheck() {
+	for {
+		CheckCertExpiry()
+		time.Sleep(certExpiryInterval)
+	}
+}
+
+// DeleteAccount removes username and everything holehubd keeps for it: the
+// holes and their ports, the certificates, the email index, the password
+// token, a pending data export and the login session.
+func DeleteAccount(username string) {
+	usershole.RemoveAll(username)
+	RemoveWebhooks(username)
+	for _, name := range UserOrgs(username) {
+		RemoveOrgMember(name, username)
+	}
+
+	for _, name := range []string{"-ca.pem", "-ca.key", "-cert.pem", "-cert.key"} {
+		certFile := configPath + "certs/" + username + name
+		if err := os.Remove(certFile); err != nil && !os.IsNotExist(err) {
+			log.Println("remove", certFile, "failed", err)
+		}
+	}
+
+	users := userstate.Users()
+	if email, _ := userstate.Email(username); email != "" {
+		emails.Del(email)
+		DropMails(email)
+	}
+	if token, _ := users.Get(username, "password_token"); token != "" {
+		passwordTokens.Del(token)
+	}
+	if token, _ := users.Get(username, "export"); token != "" {
+		RemoveExport(token)
+	}
+
+	userstate.Logout(username)
+	userstate.RemoveUnconfirmed(username)
+	userstate.RemoveUser(username)
+}
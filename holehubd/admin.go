@@ -0,0 +1,324 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type UserInfo struct {
+	Username  string           `json:"username"`
+	Email     string           `json:"email"`
+	Confirmed bool             `json:"confirmed"`
+	Admin     bool             `json:"admin"`
+	Suspended bool             `json:"suspended"`
+	Plan      string           `json:"plan"`
+	Holes     int              `json:"holes"`
+	Limits    map[string]int64 `json:"limits"`
+}
+
+func GetUserInfo(username string) UserInfo {
+	email, _ := userstate.Email(username)
+	return UserInfo{
+		Username:  username,
+		Email:     email,
+		Confirmed: userstate.IsConfirmed(username),
+		Admin:     userstate.IsAdmin(username),
+		Suspended: IsSuspended(username),
+		Plan:      UserPlan(username).Name,
+		Holes:     len(usershole.HoleIDs(username)),
+		Limits:    UserLimits(username),
+	}
+}
+
+// SearchUsers returns the users whose name or email contains query.
+func SearchUsers(query string) []UserInfo {
+	usernames, _ := userstate.AllUsernames()
+	sort.Strings(usernames)
+	users := make([]UserInfo, 0)
+	for _, username := range usernames {
+		info := GetUserInfo(username)
+		if query != "" && !strings.Contains(info.Username, query) && !strings.Contains(info.Email, query) {
+			continue
+		}
+		users = append(users, info)
+	}
+	return users
+}
+
+func IsSuspended(username string) bool {
+	return userstate.BooleanField(username, "suspended")
+}
+
+// Suspend logs username out, kills all of its holes and keeps it from
+// signing in again until Unsuspend.
+func Suspend(username string) {
+	userstate.SetBooleanField(username, "suspended", true)
+	userstate.Logout(username)
+	for _, hs := range usershole.GetAll(username) {
+		hs.Kill()
+	}
+}
+
+func Unsuspend(username string) {
+	userstate.SetBooleanField(username, "suspended", false)
+}
+
+// ForcePasswordReset replaces the password of username with an unknown one
+// and mails a reset token, so the user has to choose a new password.
+func ForcePasswordReset(username string) error {
+	token, err := userstate.GenerateUniqueConfirmationCode()
+	if err != nil {
+		return err
+	}
+	userstate.Users().Set(username, "password", userstate.HashPassword(username, token))
+	userstate.Logout(username)
+	code, err := NewPasswordToken(username)
+	if err != nil {
+		return err
+	}
+	email, _ := userstate.Email(username)
+	SendPasswordToken(username, email, code)
+	return nil
+}
+
+// suspendedCheck denies every request made with the cookie of a suspended
+// user, except for signing in and pinging which answer on their own.
+func suspendedCheck(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if req.URL.Path != "/api/signin/" && req.URL.Path != "/api/ping/" {
+		if username := userstate.Username(req); username != "" && IsSuspended(username) {
+			http.Error(w, "Permission denied!", http.StatusForbidden)
+			return
+		}
+	}
+	next(w, req)
+}
+
+func AdminRoutes(router *mux.Router, r *render.Render) {
+	// adminUser checks that the user of the path exists and returns it.
+	adminUser := func(w http.ResponseWriter, req *http.Request) (string, bool) {
+		username := mux.Vars(req)["username"]
+		if !userstate.HasUser(username) {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[7])
+			return "", false
+		}
+		return username, true
+	}
+
+	router.HandleFunc("/api/admin/users/", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		users := SearchUsers(req.Form.Get("q"))
+		r.JSON(w, http.StatusOK, map[string][]UserInfo{"users": users})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/admin/users/{username}", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		r.JSON(w, http.StatusOK, map[string]UserInfo{"user": GetUserInfo(username)})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/admin/users/{username}", func(w http.ResponseWriter, req *http.Request) {
+		admin := userstate.Username(req)
+		if !userstate.CorrectPassword(admin, requestPassword(req)) {
+			r.JSON(w, http.StatusForbidden, ErrorMessages[11])
+			return
+		}
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		DeleteAccount(username)
+		Audit(admin, "admin.account.delete", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("DELETE")
+
+	router.HandleFunc("/api/admin/users/{username}/suspend/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		Suspend(username)
+		Audit(userstate.Username(req), "admin.user.suspend", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/users/{username}/unsuspend/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		Unsuspend(username)
+		Audit(userstate.Username(req), "admin.user.unsuspend", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/users/{username}/promote/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		userstate.SetAdminStatus(username)
+		Audit(userstate.Username(req), "admin.user.promote", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/users/{username}/demote/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		userstate.RemoveAdminStatus(username)
+		Audit(userstate.Username(req), "admin.user.demote", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/users/{username}/reset_password/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		if err := ForcePasswordReset(username); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Audit(userstate.Username(req), "admin.user.reset_password", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/users/{username}/limits/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		req.ParseForm()
+		for name := range req.PostForm {
+			if !isLimitName(name) {
+				continue
+			}
+			if err := SetUserLimit(username, name, req.PostForm.Get(name)); err != nil {
+				r.JSON(w, http.StatusOK, ErrorMessages[15])
+				return
+			}
+		}
+		Audit(userstate.Username(req), "admin.user.limits", username, req)
+		r.JSON(w, http.StatusOK, map[string]map[string]int64{"limits": UserLimits(username)})
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/users/{username}/plan/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		req.ParseForm()
+		if !SetUserPlan(username, req.Form.Get("plan")) {
+			r.JSON(w, http.StatusOK, ErrorMessages[19])
+			return
+		}
+		Audit(userstate.Username(req), "admin.user.plan", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/billing/", func(w http.ResponseWriter, req *http.Request) {
+		period := billingPeriod(req)
+		usernames, _ := userstate.AllUsernames()
+		sort.Strings(usernames)
+		records := make([]UsageRecord, 0)
+		for _, username := range usernames {
+			userRecords, err := UsageRecords(username, period)
+			if err != nil {
+				r.JSON(w, http.StatusOK, ErrorMessages[18])
+				return
+			}
+			records = append(records, userRecords...)
+		}
+		if req.Form.Get("format") == "csv" {
+			writeUsageCSV(w, period, records)
+			return
+		}
+		r.JSON(w, http.StatusOK, map[string]interface{}{"period": period, "records": records})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/admin/users/{username}/holes/", func(w http.ResponseWriter, req *http.Request) {
+		username, ok := adminUser(w, req)
+		if !ok {
+			return
+		}
+		holes := usershole.GetAll(username)
+		r.JSON(w, http.StatusOK, map[string][]*HoleApp{"holes": holes})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/admin/users/{username}/holes/{holeID}/kill/", func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		hs := usershole.GetOne(vars["username"], vars["holeID"])
+		if hs == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		hs.Kill()
+		Audit(userstate.Username(req), "admin.hole.kill", hs.ID, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/users/{username}/holes/{holeID}/remove/", func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		if err := usershole.Remove(vars["username"], vars["holeID"]); err != nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		Audit(userstate.Username(req), "admin.hole.remove", vars["holeID"], req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/audit/", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		writeAudit(w, req, AuditEntries(auditFilter(req, req.Form.Get("user"))))
+	}).Methods("GET")
+
+	router.HandleFunc("/api/admin/audit/verify/", func(w http.ResponseWriter, req *http.Request) {
+		if err := VerifyAudit(); err != nil {
+			r.JSON(w, http.StatusOK, map[string]interface{}{"ok": false, "error": err.Error()})
+			return
+		}
+		r.JSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/admin/outbox/", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		mails := ListOutbox(req.Form.Get("status"))
+		r.JSON(w, http.StatusOK, map[string][]*OutboxMail{"mails": mails})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/admin/outbox/{mailID}/resend/", func(w http.ResponseWriter, req *http.Request) {
+		mailID := mux.Vars(req)["mailID"]
+		if !ResendMail(mailID) {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[14])
+			return
+		}
+		Audit(userstate.Username(req), "admin.mail.resend", mailID, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/admin/backup", func(w http.ResponseWriter, req *http.Request) {
+		dir, manifest, err := prepareBackup()
+		if err != nil {
+			log.Println("backup failed", err)
+			r.JSON(w, http.StatusOK, ErrorMessages[35])
+			return
+		}
+		defer os.RemoveAll(dir)
+		Audit(userstate.Username(req), "admin.backup", "", req)
+		name := "holehub-" + time.Unix(manifest.CreatedAt, 0).Format("20060102-150405") + ".tar"
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", "attachment; filename="+name)
+		if err := writeBackupArchive(w, dir, manifest); err != nil {
+			log.Println("backup failed", err)
+		}
+	}).Methods("GET")
+}
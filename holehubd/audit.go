@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/xyproto/pinterface"
+	"net"
+	"net/http"
+	"time"
+)
+
+// auditLog is append only. Every entry carries the hash of the entry
+// before it, so changing or dropping an entry breaks the chain from there
+// on; VerifyAudit finds the first broken link. Appends take the "audit"
+// store lock, instances sharing the store extend one chain.
+var auditLog pinterface.IList
+
+type AuditEntry struct {
+	Seq      int64  `json:"seq"`
+	Time     int64  `json:"time"`
+	Actor    string `json:"actor"`
+	Action   string `json:"action"`
+	Target   string `json:"target"`
+	IP       string `json:"ip"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// ComputeHash hashes the entry together with the hash of the previous one.
+func (entry AuditEntry) ComputeHash() string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func remoteIP(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func lastAuditEntry() (last AuditEntry) {
+	record, _ := auditLog.GetLast()
+	json.Unmarshal([]byte(record), &last)
+	return
+}
+
+// Audit appends an entry to the audit log. req may be nil for actions that
+// are not triggered over HTTP.
+func Audit(actor, action, target string, req *http.Request) {
+	defer lockStore("audit")()
+	last := lastAuditEntry()
+	entry := AuditEntry{
+		Seq:      last.Seq + 1,
+		Time:     time.Now().Unix(),
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		IP:       remoteIP(req),
+		PrevHash: last.Hash,
+	}
+	entry.Hash = entry.ComputeHash()
+	data, _ := json.Marshal(entry)
+	auditLog.Add(string(data))
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	User string
+	From int64
+	To   int64
+}
+
+func (f AuditFilter) match(entry AuditEntry) bool {
+	if f.User != "" && entry.Actor != f.User && entry.Target != f.User {
+		return false
+	}
+	if f.From > 0 && entry.Time < f.From {
+		return false
+	}
+	if f.To > 0 && entry.Time > f.To {
+		return false
+	}
+	return true
+}
+
+// AuditEntries returns the entries matching f, oldest first.
+func AuditEntries(f AuditFilter) []AuditEntry {
+	records, _ := auditLog.GetAll()
+	entries := make([]AuditEntry, 0)
+	for _, record := range records {
+		var entry AuditEntry
+		if json.Unmarshal([]byte(record), &entry) != nil {
+			continue
+		}
+		if f.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// VerifyAudit checks the hash chain of the whole log. Entries written
+// before the log was chained have no hash and are skipped.
+func VerifyAudit() error {
+	records, _ := auditLog.GetAll()
+	var prev AuditEntry
+	for i, record := range records {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(record), &entry); err != nil {
+			return fmt.Errorf("audit entry %d: %s", i, err)
+		}
+		if entry.Hash == "" && prev.Hash == "" {
+			continue
+		}
+		if entry.PrevHash != prev.Hash {
+			return fmt.Errorf("audit entry %d: chain broken before it", entry.Seq)
+		}
+		if entry.Hash != entry.ComputeHash() {
+			return fmt.Errorf("audit entry %d: hash mismatch", entry.Seq)
+		}
+		prev = entry
+	}
+	return nil
+}
+
+// auditFilter reads the from and to unix times of the query.
+func auditFilter(req *http.Request, user string) AuditFilter {
+	req.ParseForm()
+	f := AuditFilter{User: user}
+	fmt.Sscan(req.Form.Get("from"), &f.From)
+	fmt.Sscan(req.Form.Get("to"), &f.To)
+	return f
+}
+
+// writeAudit answers with entries as JSON, or as JSON lines when
+// format=jsonl.
+func writeAudit(w http.ResponseWriter, req *http.Request, entries []AuditEntry) {
+	if req.Form.Get("format") != "jsonl" {
+		data, _ := json.Marshal(map[string][]AuditEntry{"entries": entries})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=holehub-audit.jsonl")
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		enc.Encode(entry)
+	}
+}
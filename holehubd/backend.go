@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/boltdb/bolt"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	permissions "github.com/xyproto/permissionbolt"
+	"github.com/xyproto/pinterface"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var storeBackend string
+var storeDSN string
+var runWorkers bool
+
+// Permissions is the middleware of a storage backend, it guards the user
+// and admin paths and gives the user state every store is created from.
+type Permissions interface {
+	AddUserPath(prefix string)
+	AddAdminPath(prefix string)
+	SetDenyFunction(f http.HandlerFunc)
+	UserState() pinterface.IUserState
+	ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc)
+}
+
+var sqlDrivers = map[string]string{
+	"sqlite":   "sqlite3",
+	"postgres": "postgres",
+}
+
+func defaultDSN(backend string) string {
+	switch backend {
+	case "bolt":
+		return configPath + "bolt.db"
+	case "sqlite":
+		return configPath + "holehub.sqlite"
+	}
+	return ""
+}
+
+// OpenBackend opens the store of the backend, bolt keeps everything in one
+// file and serves a single holehubd, sqlite and postgres keep it in SQL.
+func OpenBackend(backend, dsn string) (Permissions, error) {
+	if dsn == "" {
+		dsn = defaultDSN(backend)
+	}
+	if backend == "bolt" {
+		// bolt.db takes a file lock, opening it while a server runs would
+		// wait for good.
+		db, err := bolt.Open(dsn, 0600, &bolt.Options{Timeout: time.Second})
+		if err == bolt.ErrTimeout {
+			return nil, errors.New("The store " + dsn + " is in use by a running holehubd, stop it first or back it up with GET /api/admin/backup")
+		}
+		if err != nil {
+			return nil, err
+		}
+		db.Close()
+		perm, err := permissions.NewWithConf(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return perm, nil
+	}
+	driver, ok := sqlDrivers[backend]
+	if !ok {
+		return nil, errors.New("Unknown store: " + backend)
+	}
+	if dsn == "" {
+		return nil, errors.New("The " + backend + " store needs a store_dsn")
+	}
+	if backend == "sqlite" && !strings.Contains(dsn, "_locking") {
+		// Only one holehubd may write to a SQLite store, the process locks
+		// do not reach further.
+		if strings.Contains(dsn, "?") {
+			dsn += "&_locking_mode=EXCLUSIVE"
+		} else {
+			dsn += "?_locking_mode=EXCLUSIVE"
+		}
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	if backend == "sqlite" {
+		// SQLite allows a single writer, keep to one connection so writes
+		// queue up instead of failing with "database is locked".
+		db.SetMaxOpenConns(1)
+	} else {
+		// The pool stays unbounded: every held store lock keeps a
+		// connection of its own, see pgLocks.
+		db.SetMaxOpenConns(0)
+	}
+	creator, err := NewSQLCreator(db)
+	if err != nil {
+		return nil, err
+	}
+	if backend == "sqlite" {
+		// The exclusive lock is taken by the first write, take it now.
+		instance, _ := creator.NewKeyValue("instance")
+		if err := instance.Set("opened_at", time.Now().UTC().Format(time.RFC3339)); err != nil {
+			db.Close()
+			return nil, errors.New("The SQLite store " + dsn + " is in use by another holehubd: " + err.Error())
+		}
+	}
+	return NewSQLPermissions(NewSQLUserState(&SQLHost{db, driver}, creator)), nil
+}
+
+// SQLPermissions is the permissions middleware of the SQL backend, it works
+// like the permissionbolt one.
+type SQLPermissions struct {
+	state      *SQLUserState
+	adminPaths []string
+	userPaths  []string
+	denied     http.HandlerFunc
+}
+
+func NewSQLPermissions(state *SQLUserState) *SQLPermissions {
+	return &SQLPermissions{
+		state: state,
+		denied: func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "Permission denied.", http.StatusForbidden)
+		},
+	}
+}
+
+func (perm *SQLPermissions) AddUserPath(prefix string) {
+	perm.userPaths = append(perm.userPaths, prefix)
+}
+
+func (perm *SQLPermissions) AddAdminPath(prefix string) {
+	perm.adminPaths = append(perm.adminPaths, prefix)
+}
+
+func (perm *SQLPermissions) SetDenyFunction(f http.HandlerFunc) {
+	perm.denied = f
+}
+
+func (perm *SQLPermissions) UserState() pinterface.IUserState {
+	return perm.state
+}
+
+func hasPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejected reports if the request may not reach its path.
+func (perm *SQLPermissions) Rejected(w http.ResponseWriter, req *http.Request) bool {
+	path := req.URL.Path
+	if hasPathPrefix(path, perm.adminPaths) && !perm.state.AdminRights(req) {
+		return true
+	}
+	if hasPathPrefix(path, perm.userPaths) && !perm.state.UserRights(req) {
+		return true
+	}
+	return false
+}
+
+func (perm *SQLPermissions) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if perm.Rejected(w, req) {
+		perm.denied(w, req)
+		return
+	}
+	next(w, req)
+}
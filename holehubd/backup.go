@@ -0,0 +1,341 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/xyproto/pinterface"
+	"github.com/xyproto/simplebolt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var backupDir string
+var backupInterval int
+var backupKeep int
+
+const backupFormat = 1
+const backupStoreFile = "holehub.sqlite"
+
+var reBackupFile = regexp.MustCompile("^holehub-[0-9]{8}-[0-9]{6}\\.tar$")
+
+// BackupManifest is the first entry of a backup archive.
+type BackupManifest struct {
+	Format        int            `json:"format"`
+	SchemaVersion int            `json:"schema_version"`
+	CreatedAt     int64          `json:"created_at"`
+	Counts        map[string]int `json:"counts"`
+}
+
+// freezeStore copies the store as it is at one instant into dir, without
+// holding up the writers, and opens the copy. bolt is copied in a read
+// transaction, the SQL stores by SQLHost.Snapshot.
+func freezeStore(dir string) (pinterface.IUserState, error) {
+	var backend, file string
+	switch host := userstate.Host().(type) {
+	case *simplebolt.Database:
+		backend, file = "bolt", filepath.Join(dir, "frozen.db")
+		err := (*bolt.DB)(host).View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(file, 0600)
+		})
+		if err != nil {
+			return nil, err
+		}
+	case *SQLHost:
+		backend, file = "sqlite", filepath.Join(dir, "frozen.sqlite")
+		if err := host.Snapshot(file); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("The store can not be snapshotted")
+	}
+	perm, err := OpenBackend(backend, file)
+	if err != nil {
+		return nil, err
+	}
+	return perm.UserState(), nil
+}
+
+// snapshotStore copies a frozen copy of the store into a new SQLite file,
+// so holes, ports and the index agree in it.
+func snapshotStore(file string) (map[string]int, error) {
+	src, err := freezeStore(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	defer src.Host().Close()
+	perm, err := OpenBackend("sqlite", file)
+	if err != nil {
+		return nil, err
+	}
+	dst := perm.UserState()
+	defer dst.Host().Close()
+	return copyStore(src, dst)
+}
+
+func tarFile(tw *tar.Writer, name, file string) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fp)
+	return err
+}
+
+// prepareBackup snapshots the store into a temporary directory, which the
+// caller removes once the archive is written.
+func prepareBackup() (dir string, manifest BackupManifest, err error) {
+	if dir, err = ioutil.TempDir("", "holehub-backup"); err != nil {
+		return
+	}
+	counts, err := snapshotStore(filepath.Join(dir, backupStoreFile))
+	if err != nil {
+		os.RemoveAll(dir)
+		return
+	}
+	manifest = BackupManifest{
+		Format:        backupFormat,
+		SchemaVersion: SchemaVersion(),
+		CreatedAt:     time.Now().Unix(),
+		Counts:        counts,
+	}
+	return
+}
+
+// writeBackupArchive writes the manifest, the snapshot in dir and the files
+// of config_dir/certs as a tar archive.
+func writeBackupArchive(w io.Writer, dir string, manifest BackupManifest) error {
+	tw := tar.NewWriter(w)
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	hdr := &tar.Header{Name: "manifest.json", Mode: 0600, Size: int64(len(data)), ModTime: time.Unix(manifest.CreatedAt, 0)}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if err := tarFile(tw, backupStoreFile, filepath.Join(dir, backupStoreFile)); err != nil {
+		return err
+	}
+
+	certs, _ := ioutil.ReadDir(configPath + "certs")
+	for _, info := range certs {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := tarFile(tw, "certs/"+info.Name(), configPath+"certs/"+info.Name()); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// WriteBackup writes a tar archive of a snapshot of the store and of
+// config_dir/certs to w while the server keeps running.
+func WriteBackup(w io.Writer) error {
+	dir, manifest, err := prepareBackup()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	return writeBackupArchive(w, dir, manifest)
+}
+
+// backupEntry returns where an entry of an archive goes in dir, and
+// refuses anything but the manifest, the store and files of certs/.
+func backupEntry(dir string, hdr *tar.Header) (string, error) {
+	name := hdr.Name
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return "", fmt.Errorf("Backup entry %s is not a file", name)
+	}
+	if name == "manifest.json" || name == backupStoreFile {
+		return filepath.Join(dir, name), nil
+	}
+	base := strings.TrimPrefix(name, "certs/")
+	if base == name || base == "" || path.Clean(name) != name || strings.Contains(base, "/") {
+		return "", fmt.Errorf("Unexpected backup entry: %s", name)
+	}
+	return filepath.Join(dir, "certs", base), nil
+}
+
+// extractBackup unpacks the archive into dir and returns its manifest.
+func extractBackup(r io.Reader, dir string) (manifest BackupManifest, err error) {
+	if err = os.MkdirAll(filepath.Join(dir, "certs"), 0700); err != nil {
+		return
+	}
+	tr := tar.NewReader(r)
+	seen := make(map[string]bool)
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		var file string
+		if file, err = backupEntry(dir, hdr); err != nil {
+			return
+		}
+		if seen[hdr.Name] {
+			err = fmt.Errorf("Duplicate backup entry: %s", hdr.Name)
+			return
+		}
+		seen[hdr.Name] = true
+		var fp *os.File
+		if fp, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return
+		}
+		_, err = io.Copy(fp, tr)
+		fp.Close()
+		if err != nil {
+			return
+		}
+	}
+	if !seen["manifest.json"] || !seen[backupStoreFile] {
+		err = fmt.Errorf("Not a holehubd backup: manifest.json or %s is missing", backupStoreFile)
+		return
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return
+	}
+	if manifest.Format != backupFormat {
+		err = fmt.Errorf("Unknown backup format: %d", manifest.Format)
+	} else if manifest.SchemaVersion > latestSchemaVersion() {
+		err = fmt.Errorf("Backup schema version %d is newer than this holehubd supports (%d)", manifest.SchemaVersion, latestSchemaVersion())
+	}
+	return
+}
+
+// RestoreBackup validates the archive and rebuilds the empty store and
+// config_dir/certs from it.
+func RestoreBackup(r io.Reader) error {
+	if names, _ := userstate.AllUsernames(); len(names) > 0 {
+		return fmt.Errorf("The store is not empty, restore into a fresh config_dir or store")
+	}
+	dir, err := ioutil.TempDir("", "holehub-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	manifest, err := extractBackup(r, dir)
+	if err != nil {
+		return err
+	}
+
+	perm, err := OpenBackend("sqlite", filepath.Join(dir, backupStoreFile))
+	if err != nil {
+		return err
+	}
+	src := perm.UserState()
+	defer src.Host().Close()
+	srcMeta, _ := src.Creator().NewKeyValue("meta")
+	if version, _ := srcMeta.Get("schema_version"); version != fmt.Sprint(manifest.SchemaVersion) {
+		return fmt.Errorf("Backup store has schema version %q, the manifest says %d", version, manifest.SchemaVersion)
+	}
+	usernames, _ := src.AllUsernames()
+	if len(usernames) != manifest.Counts["users"] {
+		return fmt.Errorf("Backup store has %d users, the manifest says %d", len(usernames), manifest.Counts["users"])
+	}
+	for _, username := range usernames {
+		for _, name := range []string{"-ca.pem", "-ca.key", "-cert.pem", "-cert.key"} {
+			if _, err := os.Stat(filepath.Join(dir, "certs", username+name)); err != nil {
+				return fmt.Errorf("Backup is missing certs/%s%s", username, name)
+			}
+		}
+	}
+
+	counts, err := copyStore(src, userstate)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(configPath+"certs", 0700); err != nil {
+		return err
+	}
+	certs, _ := ioutil.ReadDir(filepath.Join(dir, "certs"))
+	for _, info := range certs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "certs", info.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(configPath+"certs/"+info.Name(), data, 0600); err != nil {
+			return err
+		}
+	}
+	counts["certs"] = len(certs)
+	printCounts(counts)
+	// A backup of an older holehubd is brought up to date.
+	return Migrate()
+}
+
+// BackupToDir writes a new backup into backup_dir and removes the oldest
+// ones beyond backup_keep.
+func BackupToDir() (string, error) {
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return "", err
+	}
+	name := "holehub-" + time.Now().Format("20060102-150405") + ".tar"
+	tmp := filepath.Join(backupDir, "."+name)
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	err = WriteBackup(fp)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	file := filepath.Join(backupDir, name)
+	if err := os.Rename(tmp, file); err != nil {
+		return "", err
+	}
+
+	infos, _ := ioutil.ReadDir(backupDir)
+	names := make([]string, 0)
+	for _, info := range infos {
+		if reBackupFile.MatchString(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names)-backupKeep; i++ {
+		os.Remove(filepath.Join(backupDir, names[i]))
+	}
+	return file, nil
+}
+
+// RunBackups writes a backup to backup_dir every backup_interval hours.
+func RunBackups() {
+	for {
+		time.Sleep(time.Duration(backupInterval) * time.Hour)
+		if file, err := BackupToDir(); err != nil {
+			log.Println("backup failed", err)
+		} else {
+			log.Println("backup", file)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	openTestStore(t)
+	GenerateUserCa("alice")
+	GenerateUserCert("alice")
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Audit("alice", "hole.create", hs.ID, nil)
+	cert, err := ioutil.ReadFile(configPath + "certs/alice-cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteBackup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	openTestStore(t)
+	if err := RestoreBackup(bytes.NewReader(archive)); err == nil {
+		t.Fatal("restored into a store that is not empty")
+	}
+	userstate.RemoveUser("alice")
+	if err := RestoreBackup(bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	if !userstate.CorrectPassword("alice", "secret") {
+		t.Fatal("alice not restored")
+	}
+	restored := usershole.GetOne("alice", hs.ID)
+	if restored == nil || restored.Name != "web" || restored.Port != hs.Port {
+		t.Fatal("hole restored as", restored)
+	}
+	if ids := usershole.HoleIDsByName("alice", "web"); len(ids) != 1 {
+		t.Fatal("name index restored as", ids)
+	}
+	if entries := AuditEntries(AuditFilter{User: "alice"}); len(entries) != 1 {
+		t.Fatal(len(entries), "audit entries restored")
+	}
+	if data, _ := ioutil.ReadFile(configPath + "certs/alice-cert.pem"); !bytes.Equal(data, cert) {
+		t.Fatal("certificate not restored")
+	}
+}
+
+func TestRestoreRejects(t *testing.T) {
+	openTestStore(t)
+	userstate.RemoveUser("alice")
+	for name, entries := range map[string][]string{
+		"no manifest":   {backupStoreFile},
+		"path escape":   {"manifest.json", "certs/../holehub.sqlite"},
+		"nested cert":   {"manifest.json", "certs/a/b.pem"},
+		"unknown entry": {"manifest.json", "config.tpl"},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, entry := range entries {
+			tw.WriteHeader(&tar.Header{Name: entry, Mode: 0600, Size: 2, Typeflag: tar.TypeReg})
+			tw.Write([]byte("{}"))
+		}
+		tw.Close()
+		if err := RestoreBackup(&buf); err == nil {
+			t.Error("restored a backup with", name)
+		}
+	}
+}
+
+func TestBackupToDir(t *testing.T) {
+	openTestStore(t)
+	GenerateUserCa("alice")
+	GenerateUserCert("alice")
+	backupDir = filepath.Join(configPath, "backups")
+	backupKeep = 2
+	os.MkdirAll(backupDir, 0700)
+	for _, name := range []string{"holehub-20200101-000000.tar", "holehub-20200102-000000.tar", "notes.txt"} {
+		ioutil.WriteFile(filepath.Join(backupDir, name), nil, 0600)
+	}
+
+	file, err := BackupToDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := ioutil.ReadDir(backupDir)
+	names := make([]string, 0)
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	want := []string{"holehub-20200102-000000.tar", filepath.Base(file), "notes.txt"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatal("backup_dir holds", names, "want", want)
+	}
+}
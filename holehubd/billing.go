@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/xyproto/pinterface"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Plan bundles the limits of the users assigned to it.
+type Plan struct {
+	Name   string           `json:"name"`
+	Limits map[string]int64 `json:"limits"`
+}
+
+var defaultPlan string
+var plans = map[string]Plan{
+	"free": {Name: "free", Limits: map[string]int64{
+		"holes": 3, "running_holes": 1, "ports": 3, "transfer": 10 << 30, "connections": 20,
+	}},
+	"team": {Name: "team", Limits: map[string]int64{
+		"holes": 20, "running_holes": 10, "ports": 20, "transfer": 200 << 30, "connections": 200,
+	}},
+	"enterprise": {Name: "enterprise", Limits: map[string]int64{}},
+}
+
+// LoadPlans replaces the built in plans with config_dir/plans.json when it
+// exists. The file holds a list of plans.
+func LoadPlans() error {
+	data, err := ioutil.ReadFile(configPath + "plans.json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var list []Plan
+		if err = json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		plans = make(map[string]Plan)
+		for _, plan := range list {
+			plans[plan.Name] = plan
+		}
+	}
+	if _, ok := plans[defaultPlan]; defaultPlan != "" && !ok {
+		return fmt.Errorf("default plan %s is not defined", defaultPlan)
+	}
+	return nil
+}
+
+func PlanNames() []string {
+	names := make([]string, 0, len(plans))
+	for name := range plans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UserPlan returns the plan username is assigned to. Without a plan and a
+// --default_plan it is an empty plan, which leaves the --max_* limits.
+func UserPlan(username string) Plan {
+	name, _ := userstate.Users().Get(username, "plan")
+	if plan, ok := plans[name]; ok {
+		return plan
+	}
+	return plans[defaultPlan]
+}
+
+func SetUserPlan(username, name string) bool {
+	if _, ok := plans[name]; !ok {
+		return false
+	}
+	userstate.Users().Set(username, "plan", name)
+	return true
+}
+
+// usageRecords keeps one record per user and day, keyed <user>:<date>.
+var usageRecords pinterface.IHashMap
+
+var usageInterval = time.Minute
+
+var usageFields = []string{"hole_seconds", "bytes_in", "bytes_out", "peak_connections"}
+
+type UsageRecord struct {
+	Username        string  `json:"username"`
+	Date            string  `json:"date"`
+	Plan            string  `json:"plan"`
+	HoleHours       float64 `json:"hole_hours"`
+	BytesIn         int64   `json:"bytes_in"`
+	BytesOut        int64   `json:"bytes_out"`
+	PeakConnections int64   `json:"peak_connections"`
+}
+
+func usageRecordKey(username string, t time.Time) string {
+	return username + ":" + t.Format("2006-01-02")
+}
+
+func getUsageField(key, field string) int64 {
+	value, _ := usageRecords.Get(key, field)
+	i, _ := strconv.ParseInt(value, 10, 64)
+	return i
+}
+
+// updateUsage changes one field of today's record of username, under a
+// store lock so instances sharing the store do not lose updates.
+func updateUsage(username, field string, fn func(int64) int64) {
+	defer lockStore("usage:" + username)()
+	key := usageRecordKey(username, time.Now())
+	usageRecords.Set(key, "plan", UserPlan(username).Name)
+	usageRecords.Set(key, field, strconv.FormatInt(fn(getUsageField(key, field)), 10))
+}
+
+func recordBytes(username string, in, out int64) {
+	updateUsage(username, "bytes_in", func(v int64) int64 { return v + in })
+	updateUsage(username, "bytes_out", func(v int64) int64 { return v + out })
+}
+
+func recordConnections(username string, count int64) {
+	updateUsage(username, "peak_connections", func(v int64) int64 {
+		if count > v {
+			return count
+		}
+		return v
+	})
+}
+
+// RecordHoleTime adds the time the holes of every user, and of the
+// organizations it accounts for, ran during the last interval to today's
+// records.
+func RecordHoleTime(interval time.Duration) {
+	usernames, _ := userstate.AllUsernames()
+	for _, username := range usernames {
+		var running int64
+		for _, owner := range accountOwners(username) {
+			for _, hs := range usershole.GetAll(owner) {
+				if hs.Alive() {
+					running++
+				}
+			}
+		}
+		if running == 0 {
+			continue
+		}
+		seconds := running * int64(interval/time.Second)
+		updateUsage(username, "hole_seconds", func(v int64) int64 { return v + seconds })
+	}
+}
+
+func RunUsageRecorder() {
+	for {
+		time.Sleep(usageInterval)
+		RecordHoleTime(usageInterval)
+	}
+}
+
+// UsageRecords returns the daily records of username in the billing period,
+// a month written as 2006-01.
+func UsageRecords(username, period string) ([]UsageRecord, error) {
+	start, err := time.Parse("2006-01", period)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]UsageRecord, 0)
+	for day := start; day.Month() == start.Month(); day = day.AddDate(0, 0, 1) {
+		key := usageRecordKey(username, day)
+		if ok, _ := usageRecords.Exists(key); !ok {
+			continue
+		}
+		plan, _ := usageRecords.Get(key, "plan")
+		records = append(records, UsageRecord{
+			Username:        username,
+			Date:            day.Format("2006-01-02"),
+			Plan:            plan,
+			HoleHours:       float64(getUsageField(key, "hole_seconds")) / 3600,
+			BytesIn:         getUsageField(key, "bytes_in"),
+			BytesOut:        getUsageField(key, "bytes_out"),
+			PeakConnections: getUsageField(key, "peak_connections"),
+		})
+	}
+	return records, nil
+}
+
+func billingPeriod(req *http.Request) string {
+	req.ParseForm()
+	if period := req.Form.Get("period"); period != "" {
+		return period
+	}
+	return time.Now().Format("2006-01")
+}
+
+// writeUsageCSV writes records as a CSV download.
+func writeUsageCSV(w http.ResponseWriter, period string, records []UsageRecord) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=holehub-usage-"+period+".csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"username", "date", "plan", "hole_hours", "bytes_in", "bytes_out", "peak_connections"})
+	for _, record := range records {
+		cw.Write([]string{
+			record.Username,
+			record.Date,
+			record.Plan,
+			strconv.FormatFloat(record.HoleHours, 'f', 2, 64),
+			strconv.FormatInt(record.BytesIn, 10),
+			strconv.FormatInt(record.BytesOut, 10),
+			strconv.FormatInt(record.PeakConnections, 10),
+		})
+	}
+	cw.Flush()
+}
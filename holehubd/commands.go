@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var reLaunchFile = regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\\.json$")
+
+var commandUsage = `Usage: holehubd [flags] <command> [args]
+
+Maintenance commands work on the store and config_dir directly. Stop the
+server before running them.
+
+  user add <username> <password> <email>   add a confirmed user
+  user list                                list users
+  user delete <username>                   delete a user and its holes
+  user promote <username>                  grant admin rights
+  user demote <username>                   revoke admin rights
+  hole list [owner]                        list holes, owner is a user or org:<name>
+  hole kill <holeID>                       stop a hole
+  hole gc                                  drop orphaned holes and launch files
+  hole reconcile                           fix launch files, restart holes that should run
+  cert reissue <username>                  generate a new ca and cert
+  db check                                 report inconsistencies
+  db version                               show the schema version of the store
+  db copy <sqlite|postgres> [dsn]          copy the store into an empty SQL store
+  backup <file>                            write a backup archive, - for stdout
+  restore <file>                           rebuild an empty store and certs from a backup, - for stdin
+
+backup also runs next to a server sharing a SQL store. A running server on
+bolt.db is backed up with GET /api/admin/backup or --backup_dir.
+`
+
+// RunCommand runs a maintenance command given on the command line.
+func RunCommand(args []string) error {
+	if len(args) < 2 {
+		fmt.Print(commandUsage)
+		return fmt.Errorf("Not enough arguments.")
+	}
+	// backup and db version only read, they leave the store as they found
+	// it even when it is of another holehubd version.
+	if args[0] == "backup" {
+		return backupCommand(args[1])
+	}
+	if args[0]+" "+args[1] != "db version" {
+		if err := Migrate(); err != nil {
+			return err
+		}
+	}
+	if args[0] == "restore" {
+		return restoreCommand(args[1])
+	}
+	var err error
+	switch args[0] + " " + args[1] {
+	case "user add":
+		err = userAddCommand(args[2:])
+	case "user list":
+		err = userListCommand()
+	case "user delete":
+		err = userCommand(args[2:], func(username string) {
+			DeleteAccount(username)
+			Audit("holehubd", "admin.account.delete", username, nil)
+		})
+	case "user promote":
+		err = userCommand(args[2:], func(username string) {
+			userstate.SetAdminStatus(username)
+			Audit("holehubd", "admin.user.promote", username, nil)
+		})
+	case "user demote":
+		err = userCommand(args[2:], func(username string) {
+			userstate.RemoveAdminStatus(username)
+			Audit("holehubd", "admin.user.demote", username, nil)
+		})
+	case "hole list":
+		err = holeListCommand(args[2:])
+	case "hole kill":
+		err = holeKillCommand(args[2:])
+	case "hole gc":
+		err = holeGCCommand()
+	case "hole reconcile":
+		for _, change := range Reconcile() {
+			fmt.Println(change)
+		}
+	case "cert reissue":
+		err = userCommand(args[2:], func(username string) {
+			GenerateUserCa(username)
+			GenerateUserCert(username)
+			Audit("holehubd", "cert.reissue", username, nil)
+		})
+	case "db check":
+		err = dbCheckCommand()
+	case "db version":
+		fmt.Printf("%d (latest %d)\n", SchemaVersion(), latestSchemaVersion())
+	case "db copy":
+		err = dbCopyCommand(args[2:])
+	default:
+		fmt.Print(commandUsage)
+		err = fmt.Errorf("Unknown command: %s", strings.Join(args, " "))
+	}
+	return err
+}
+
+func userCommand(args []string, fn func(username string)) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Not enough arguments.")
+	}
+	if !userstate.HasUser(args[0]) {
+		return fmt.Errorf("User NotFound: %s", args[0])
+	}
+	fn(args[0])
+	return nil
+}
+
+func userAddCommand(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("Not enough arguments.")
+	}
+	username, password, email := args[0], args[1], args[2]
+	if !ValidUsername(username) {
+		return fmt.Errorf("Username format error")
+	}
+	if userstate.HasUser(username) {
+		return fmt.Errorf("User is already exists.")
+	}
+	if name, _ := emails.Get(email); name != "" {
+		return fmt.Errorf("Email is already exists.")
+	}
+	if !isEmail(email) {
+		return fmt.Errorf("Email format error")
+	}
+	CreateAccount(username, password, email)
+	userstate.MarkConfirmed(username)
+	Audit("holehubd", "admin.account.create", username, nil)
+	return nil
+}
+
+func userListCommand() error {
+	fmt.Println("Username\t\tEmail\t\t\tConfirmed\tAdmin\tSuspended\tHoles")
+	for _, user := range SearchUsers("") {
+		fmt.Printf("%s\t\t%s\t\t%v\t\t%v\t%v\t\t%d\n", user.Username, user.Email,
+			user.Confirmed, user.Admin, user.Suspended, user.Holes)
+	}
+	return nil
+}
+
+func holeListCommand(args []string) error {
+	owners := allOwners()
+	if len(args) > 0 {
+		owners = args[:1]
+	}
+	sort.Strings(owners)
+	fmt.Println("ID\t\t\t\t\tOwner\t\tName\t\tPort\t\tAlive")
+	for _, owner := range owners {
+		for _, hs := range usershole.GetAll(owner) {
+			fmt.Printf("%s\t%s\t\t%s\t\t%s/%s\t%v\n", hs.ID, owner, hs.Name, hs.Port, hs.Scheme, hs.IsAlive)
+		}
+	}
+	return nil
+}
+
+func holeKillCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Not enough arguments.")
+	}
+	hs := usershole.GetOne(HoleOwner(args[0]), args[0])
+	if hs == nil {
+		return fmt.Errorf("HoleApp is not exists: %s", args[0])
+	}
+	if !hs.Alive() {
+		return fmt.Errorf("HoleApp is not running: %s", args[0])
+	}
+	Audit("holehubd", "admin.hole.kill", args[0], nil)
+	return hs.Kill()
+}
+
+// allOwners returns every user and organization that can own holes.
+func allOwners() []string {
+	owners, _ := userstate.AllUsernames()
+	names, _ := usershole.orgs.GetAll()
+	for _, name := range names {
+		owners = append(owners, OrgOwner(name))
+	}
+	return owners
+}
+
+// holeOwners maps every hole id referenced by an owner to that owner.
+func holeOwners() map[string]string {
+	owners := make(map[string]string)
+	for _, owner := range allOwners() {
+		for _, holeID := range usershole.HoleIDs(owner) {
+			owners[holeID] = owner
+		}
+	}
+	return owners
+}
+
+// launchFiles returns the hole ids that have a launch file in config_dir.
+func launchFiles() []string {
+	files, _ := ioutil.ReadDir(configPath)
+	holeIDs := make([]string, 0)
+	for _, file := range files {
+		if reLaunchFile.MatchString(file.Name()) {
+			holeIDs = append(holeIDs, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	return holeIDs
+}
+
+// holeGCCommand removes holes no user references and launch files of
+// holes that no longer exist, and gives their ports back.
+func holeGCCommand() error {
+	owners := holeOwners()
+	holeIDs, _ := usershole.holes.GetAll()
+	for _, holeID := range holeIDs {
+		if _, ok := owners[holeID]; ok {
+			continue
+		}
+		port, _ := usershole.holes.Get(holeID, "port")
+		hs := &HoleApp{ID: holeID}
+		if hs.Alive() {
+			hs.Kill()
+		}
+		usershole.holes.Del(holeID)
+		usershole.FreePort(port)
+		fmt.Println("removed orphaned hole", holeID)
+	}
+	for _, holeID := range launchFiles() {
+		if _, ok := owners[holeID]; ok {
+			continue
+		}
+		os.Remove(configPath + holeID + ".json")
+		fmt.Println("removed orphaned launch file", holeID+".json")
+	}
+	return nil
+}
+
+func dbCheckCommand() error {
+	problems := 0
+	report := func(format string, v ...interface{}) {
+		problems++
+		fmt.Printf(format+"\n", v...)
+	}
+
+	usernames, _ := userstate.AllUsernames()
+	seen := make(map[string]string)
+	for _, username := range usernames {
+		if !ValidUsername(username) {
+			report("user %s: invalid name, it may collide with an organization", username)
+		}
+		email, _ := userstate.Email(username)
+		if name, _ := emails.Get(email); name != username {
+			report("user %s: email %s is indexed to %q", username, email, name)
+		}
+		for _, name := range []string{"-ca.pem", "-ca.key", "-cert.pem", "-cert.key"} {
+			if _, err := os.Stat(configPath + "certs/" + username + name); err != nil {
+				report("user %s: missing certs/%s%s", username, username, name)
+			}
+		}
+	}
+	for _, owner := range allOwners() {
+		names := make(map[string]int)
+		for _, holeID := range usershole.HoleIDs(owner) {
+			if other, ok := seen[holeID]; ok {
+				report("hole %s: owned by both %s and %s", holeID, other, owner)
+			}
+			seen[holeID] = owner
+			rec := usershole.GetRecord(holeID)
+			if rec == nil {
+				report("hole %s: owned by %s but has no record", holeID, owner)
+				continue
+			}
+			if rec.Owner != owner {
+				report("hole %s: indexed for %s but owned by %q", holeID, owner, rec.Owner)
+			}
+			if indexOf(usershole.HoleIDsByName(owner, rec.Name), holeID) < 0 {
+				report("hole %s: missing from the name index of %s", holeID, owner)
+			}
+			names[rec.Name]++
+		}
+		for name, count := range names {
+			if name != "" && count > 1 {
+				report("owner %s: %d holes are called %s", owner, count, name)
+			}
+		}
+	}
+
+	holeIDs, _ := usershole.holes.GetAll()
+	for _, holeID := range holeIDs {
+		if _, ok := seen[holeID]; !ok {
+			report("hole %s: no owner, run hole gc", holeID)
+		}
+	}
+	for _, holeID := range launchFiles() {
+		if _, ok := seen[holeID]; !ok {
+			report("hole %s: launch file without hole, run hole gc", holeID)
+		}
+	}
+
+	if err := VerifyAudit(); err != nil {
+		report("%s", err)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func dbCopyCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Not enough arguments.")
+	}
+	dsn := ""
+	if len(args) > 1 {
+		dsn = args[1]
+	}
+	return CopyStore(args[0], dsn)
+}
+
+func backupCommand(file string) error {
+	if file == "-" {
+		return WriteBackup(os.Stdout)
+	}
+	fp, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := WriteBackup(fp); err != nil {
+		fp.Close()
+		os.Remove(file)
+		return err
+	}
+	return fp.Close()
+}
+
+func restoreCommand(file string) error {
+	if file == "-" {
+		return RestoreBackup(os.Stdin)
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return RestoreBackup(fp)
+}
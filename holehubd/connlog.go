@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"github.com/xyproto/pinterface"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// connectionLog persists every public connection reported by the hole
+// server, keyed <holeID>:<report time in nanoseconds>. connectionIndex
+// lists the UTC days a hole reported connections in its days field, the
+// keys of a day are in the set connection_day:<holeID>:<yyyymmdd>.
+var connectionLog pinterface.IHashMap
+var connectionIndex pinterface.IHashMap
+var connectionLogDays int
+
+const connectionRingSize = 100
+
+type ConnectionEntry struct {
+	Remote    string `json:"remote"`
+	StartedAt int64  `json:"started_at"`
+	EndedAt   int64  `json:"ended_at"`
+	BytesIn   int64  `json:"bytes_in"`
+	BytesOut  int64  `json:"bytes_out"`
+	Reason    string `json:"reason"`
+}
+
+// connectionRings keeps the latest connections of each hole in memory. A
+// ring is loaded from the store the first time it is needed.
+var connectionRings = struct {
+	sync.Mutex
+	holes map[string][]ConnectionEntry
+}{holes: make(map[string][]ConnectionEntry)}
+
+func connectionDay(t time.Time) string {
+	return t.UTC().Format("20060102")
+}
+
+func connectionDays(holeID string) []string {
+	days := make([]string, 0)
+	data, _ := connectionIndex.Get(holeID, "days")
+	if data != "" {
+		json.Unmarshal([]byte(data), &days)
+	}
+	return days
+}
+
+func setConnectionDays(holeID string, days []string) {
+	data, _ := json.Marshal(days)
+	connectionIndex.Set(holeID, "days", string(data))
+}
+
+func connectionDaySet(holeID, day string) pinterface.ISet {
+	set, _ := userstate.Creator().NewSet("connection_day:" + holeID + ":" + day)
+	return set
+}
+
+// indexConnection adds a key of the connection log of the hole to the
+// index. The caller holds the connlog store lock of the hole.
+func indexConnection(holeID, key string, t time.Time) {
+	day := connectionDay(t)
+	days := connectionDays(holeID)
+	if indexOf(days, day) < 0 {
+		setConnectionDays(holeID, append(days, day))
+	}
+	connectionDaySet(holeID, day).Add(key)
+}
+
+// dayConnections returns the persisted connections of the hole reported on
+// day.
+func dayConnections(holeID, day string) []ConnectionEntry {
+	entries := make([]ConnectionEntry, 0)
+	keys, _ := connectionDaySet(holeID, day).GetAll()
+	for _, key := range keys {
+		data, _ := connectionLog.Get(key, "entry")
+		var entry ConnectionEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func sortConnections(entries []ConnectionEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].EndedAt < entries[j].EndedAt })
+}
+
+// storedConnections returns the persisted connections of the hole ended
+// between from and to, oldest first. A connection is reported once it
+// ended, so the days before from are skipped.
+func storedConnections(holeID string, from, to int64) []ConnectionEntry {
+	entries := make([]ConnectionEntry, 0)
+	fromDay := connectionDay(time.Unix(from, 0))
+	for _, day := range connectionDays(holeID) {
+		if from > 0 && day < fromDay {
+			continue
+		}
+		for _, entry := range dayConnections(holeID, day) {
+			if entry.EndedAt < from || (to > 0 && entry.EndedAt > to) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sortConnections(entries)
+	return entries
+}
+
+// loadConnectionRing returns the ring of the hole, read from the newest
+// days of the store when it is not in memory yet.
+func loadConnectionRing(holeID string) []ConnectionEntry {
+	if ring, ok := connectionRings.holes[holeID]; ok {
+		return ring
+	}
+	ring := make([]ConnectionEntry, 0)
+	days := connectionDays(holeID)
+	sort.Strings(days)
+	for i := len(days) - 1; i >= 0 && len(ring) < connectionRingSize; i-- {
+		ring = append(dayConnections(holeID, days[i]), ring...)
+	}
+	sortConnections(ring)
+	if len(ring) > connectionRingSize {
+		ring = ring[len(ring)-connectionRingSize:]
+	}
+	return ring
+}
+
+// LogConnection records a closed public connection of the hole.
+func LogConnection(holeID string, entry ConnectionEntry) {
+	data, _ := json.Marshal(entry)
+	connectionRings.Lock()
+	defer connectionRings.Unlock()
+	// The ring is loaded before the entry is stored, or it would hold the
+	// entry twice.
+	ring := loadConnectionRing(holeID)
+	now := time.Now()
+	key := holeID + ":" + strconv.FormatInt(now.UnixNano(), 10)
+	unlock := lockStore("connlog:" + holeID)
+	connectionLog.Set(key, "entry", string(data))
+	indexConnection(holeID, key, now)
+	unlock()
+
+	ring = append(ring, entry)
+	if len(ring) > connectionRingSize {
+		ring = ring[len(ring)-connectionRingSize:]
+	}
+	connectionRings.holes[holeID] = ring
+}
+
+// HoleConnections returns the latest connections of the hole from memory,
+// or the persisted ones when from is set.
+func HoleConnections(holeID string, from, to int64) []ConnectionEntry {
+	if from > 0 {
+		return storedConnections(holeID, from, to)
+	}
+	connectionRings.Lock()
+	defer connectionRings.Unlock()
+	ring := loadConnectionRing(holeID)
+	connectionRings.holes[holeID] = ring
+	return append([]ConnectionEntry{}, ring...)
+}
+
+// PruneConnectionLog drops the days of connections older than
+// --connection_log_days, and the connections of holes that no longer exist.
+func PruneConnectionLog() {
+	expired := connectionDay(time.Now().AddDate(0, 0, -connectionLogDays))
+	holeIDs, _ := connectionIndex.GetAll()
+	for _, holeID := range holeIDs {
+		exists, _ := usershole.holes.Exists(holeID)
+		unlock := lockStore("connlog:" + holeID)
+		kept := make([]string, 0)
+		for _, day := range connectionDays(holeID) {
+			if exists && day >= expired {
+				kept = append(kept, day)
+				continue
+			}
+			set := connectionDaySet(holeID, day)
+			keys, _ := set.GetAll()
+			for _, key := range keys {
+				connectionLog.Del(key)
+			}
+			set.Remove()
+		}
+		if len(kept) == 0 {
+			connectionIndex.Del(holeID)
+		} else {
+			setConnectionDays(holeID, kept)
+		}
+		unlock()
+	}
+
+	connectionRings.Lock()
+	for holeID := range connectionRings.holes {
+		if exists, _ := usershole.holes.Exists(holeID); !exists {
+			delete(connectionRings.holes, holeID)
+		}
+	}
+	connectionRings.Unlock()
+}
+
+func RunConnectionLogPruner() {
+	for {
+		PruneConnectionLog()
+		time.Sleep(statsInterval)
+	}
+}
+
+// connectionsHandler answers the connections of the hole found by getHole.
+func connectionsHandler(r *render.Render, getHole func(req *http.Request) *HoleApp) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		hs := getHole(req)
+		if hs == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		req.ParseForm()
+		r.JSON(w, http.StatusOK, map[string][]ConnectionEntry{
+			"connections": HoleConnections(hs.ID, formInt(req, "from"), formInt(req, "to")),
+		})
+	}
+}
+
+func ConnectionLogRoutes(router *mux.Router, r *render.Render) {
+	router.HandleFunc("/api/holes/{holeID}/connections", connectionsHandler(r, func(req *http.Request) *HoleApp {
+		return usershole.GetOne(userstate.Username(req), mux.Vars(req)["holeID"])
+	})).Methods("GET")
+
+	router.HandleFunc("/api/orgs/{org}/holes/{holeID}/connections", connectionsHandler(r, func(req *http.Request) *HoleApp {
+		vars := mux.Vars(req)
+		if !HasOrgRole(vars["org"], userstate.Username(req), "viewer") {
+			return nil
+		}
+		return usershole.GetOne(OrgOwner(vars["org"]), vars["holeID"])
+	})).Methods("GET")
+
+	router.HandleFunc("/api/report/holes/{holeID}/connections/", func(w http.ResponseWriter, req *http.Request) {
+		if !reportAllowed(req) {
+			http.Error(w, "Permission denied!", http.StatusForbidden)
+			return
+		}
+		holeID := mux.Vars(req)["holeID"]
+		if ok, _ := usershole.holes.Exists(holeID); !ok {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		req.ParseForm()
+		entry := ConnectionEntry{
+			Remote:    req.Form.Get("remote"),
+			StartedAt: formInt(req, "started_at"),
+			EndedAt:   formInt(req, "ended_at"),
+			BytesIn:   formInt(req, "bytes_in"),
+			BytesOut:  formInt(req, "bytes_out"),
+			Reason:    req.Form.Get("reason"),
+		}
+		if entry.EndedAt == 0 {
+			entry.EndedAt = time.Now().Unix()
+		}
+		LogConnection(holeID, entry)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+}
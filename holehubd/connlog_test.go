@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// forgetConnectionRings drops the rings in memory, like a restart.
+func forgetConnectionRings() {
+	connectionRings.Lock()
+	connectionRings.holes = make(map[string][]ConnectionEntry)
+	connectionRings.Unlock()
+}
+
+func TestLogConnectionOnce(t *testing.T) {
+	openTestStore(t)
+	forgetConnectionRings()
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	LogConnection(hs.ID, ConnectionEntry{Remote: "10.0.0.1:1234", EndedAt: time.Now().Unix()})
+	if n := len(HoleConnections(hs.ID, 0, 0)); n != 1 {
+		t.Fatalf("%d connections, want 1", n)
+	}
+
+	forgetConnectionRings()
+	LogConnection(hs.ID, ConnectionEntry{Remote: "10.0.0.2:1234", EndedAt: time.Now().Unix()})
+	entries := HoleConnections(hs.ID, 0, 0)
+	if len(entries) != 2 {
+		t.Fatalf("%d connections after restart, want 2", len(entries))
+	}
+	if entries[1].Remote != "10.0.0.2:1234" {
+		t.Fatal("latest connection is", entries[1].Remote)
+	}
+}
+
+func TestConnectionRingNewestDays(t *testing.T) {
+	openTestStore(t)
+	forgetConnectionRings()
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for d := 2; d >= 0; d-- {
+		day := now.AddDate(0, 0, -d)
+		for i := 0; i < connectionRingSize; i++ {
+			at := day.Add(time.Duration(i) * time.Second)
+			key := hs.ID + ":" + strconv.FormatInt(at.UnixNano(), 10)
+			connectionLog.Set(key, "entry", `{"remote":"day`+strconv.Itoa(d)+`","ended_at":`+strconv.FormatInt(at.Unix(), 10)+`}`)
+			indexConnection(hs.ID, key, at)
+		}
+	}
+
+	ring := HoleConnections(hs.ID, 0, 0)
+	if len(ring) != connectionRingSize {
+		t.Fatalf("%d connections in the ring, want %d", len(ring), connectionRingSize)
+	}
+	for _, entry := range ring {
+		if entry.Remote != "day0" {
+			t.Fatal("ring holds a connection of", entry.Remote)
+		}
+	}
+	if n := len(HoleConnections(hs.ID, now.AddDate(0, 0, -3).Unix(), 0)); n != 3*connectionRingSize {
+		t.Fatalf("%d stored connections, want %d", n, 3*connectionRingSize)
+	}
+}
+
+func TestPruneConnectionLog(t *testing.T) {
+	openTestStore(t)
+	forgetConnectionRings()
+	connectionLogDays = 7
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().AddDate(0, 0, -10)
+	key := hs.ID + ":" + strconv.FormatInt(old.UnixNano(), 10)
+	connectionLog.Set(key, "entry", `{"remote":"old","ended_at":`+strconv.FormatInt(old.Unix(), 10)+`}`)
+	indexConnection(hs.ID, key, old)
+	LogConnection(hs.ID, ConnectionEntry{Remote: "new", EndedAt: time.Now().Unix()})
+
+	PruneConnectionLog()
+	if ok, _ := connectionLog.Exists(key); ok {
+		t.Error("expired connection kept")
+	}
+	if days := connectionDays(hs.ID); len(days) != 1 || days[0] != connectionDay(time.Now()) {
+		t.Error("days left", days)
+	}
+	if n := len(HoleConnections(hs.ID, old.Add(-time.Hour).Unix(), 0)); n != 1 {
+		t.Fatalf("%d stored connections, want 1", n)
+	}
+
+	usershole.Remove("alice", hs.ID)
+	PruneConnectionLog()
+	if ok, _ := connectionIndex.Exists(hs.ID); ok {
+		t.Error("connections of a removed hole kept")
+	}
+}
+
+func TestMigrateConnectionIndex(t *testing.T) {
+	openTestStore(t)
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		at := now.AddDate(0, 0, -i)
+		key := hs.ID + ":" + strconv.FormatInt(at.UnixNano(), 10)
+		connectionLog.Set(key, "entry", `{"ended_at":`+strconv.FormatInt(at.Unix(), 10)+`}`)
+	}
+	if err := migrateConnectionIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(connectionDays(hs.ID)); n != 3 {
+		t.Fatalf("%d days indexed, want 3", n)
+	}
+	if n := len(storedConnections(hs.ID, now.AddDate(0, 0, -4).Unix(), 0)); n != 3 {
+		t.Fatalf("%d connections indexed, want 3", n)
+	}
+}
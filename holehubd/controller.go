@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Every hole has a desired_state, set by start and kill, and an
+// observed_state. The controller drives the observed state toward the
+// desired one every --controller_interval seconds, restarting crashed holes
+// with a growing backoff.
+var controllerInterval int
+
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+
+	ObservedRunning   = "running"
+	ObservedStopped   = "stopped"
+	ObservedCrashed   = "crashed"
+	ObservedBackoff   = "backoff"
+	ObservedCrashLoop = "crashloop"
+)
+
+var restartMinBackoff = 5 * time.Second
+var restartMaxBackoff = 5 * time.Minute
+
+// crashLoopRestarts is how many restarts in a row without staying up for
+// stableAfter make a hole crash looping.
+var crashLoopRestarts = 5
+var stableAfter = 10 * time.Minute
+
+func getHoleInt(holeID, key string) int64 {
+	value, _ := usershole.holes.Get(holeID, key)
+	i, _ := strconv.ParseInt(value, 10, 64)
+	return i
+}
+
+func setHoleInt(holeID, key string, value int64) {
+	usershole.holes.Set(holeID, key, strconv.FormatInt(value, 10))
+}
+
+func restartBackoff(restarts int64) time.Duration {
+	backoff := restartMinBackoff
+	for i := int64(1); i < restarts && backoff < restartMaxBackoff; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > restartMaxBackoff {
+		backoff = restartMaxBackoff
+	}
+	return backoff
+}
+
+// setDesiredState records what the hole should be doing and forgets the
+// restarts of a previous run.
+func setDesiredState(holeID, state string) {
+	usershole.holes.Set(holeID, "desired_state", state)
+	usershole.holes.Set(holeID, "restarts", "0")
+	usershole.holes.DelKey(holeID, "next_start_at")
+	usershole.holes.DelKey(holeID, "last_error")
+	touchHole(holeID)
+}
+
+// observeLaunch records the outcome of writing the launch file of a hole.
+func observeLaunch(holeID string, err error) {
+	if err != nil {
+		usershole.holes.Set(holeID, "observed_state", ObservedCrashed)
+		usershole.holes.Set(holeID, "last_error", err.Error())
+		return
+	}
+	usershole.holes.Set(holeID, "observed_state", ObservedRunning)
+	setHoleInt(holeID, "running_since", time.Now().Unix())
+}
+
+// HoleCrashed records a crash of the hole reported by the hole server.
+func HoleCrashed(holeID, reason string) {
+	defer lockHole(holeID)()
+	if !holeExists(holeID) {
+		return
+	}
+	if reason == "" {
+		reason = "hole server reported a crash"
+	}
+	usershole.holes.Set(holeID, "observed_state", ObservedCrashed)
+	usershole.holes.Set(holeID, "last_error", reason)
+}
+
+// DriveHole moves the hole one step toward its desired state and returns
+// what it did, or an empty string when nothing had to change.
+func DriveHole(owner string, hs *HoleApp) string {
+	defer lockHole(hs.ID)()
+	if !holeExists(hs.ID) {
+		return ""
+	}
+	desired, _ := usershole.holes.Get(hs.ID, "desired_state")
+	observed, _ := usershole.holes.Get(hs.ID, "observed_state")
+	alive := hs.Alive()
+	now := time.Now()
+
+	switch desired {
+	case "":
+		if alive {
+			usershole.holes.Set(hs.ID, "desired_state", DesiredRunning)
+			observeLaunch(hs.ID, nil)
+		}
+		return ""
+
+	case DesiredStopped:
+		if alive {
+			hs.unlaunch()
+			return "killed stopped hole"
+		}
+		if observed != ObservedStopped {
+			usershole.holes.Set(hs.ID, "observed_state", ObservedStopped)
+		}
+		return ""
+	}
+
+	// A hole waiting in backoff or crash looping still has to be restarted,
+	// even when its launch file is there.
+	restarts := getHoleInt(hs.ID, "restarts")
+	healthy := observed != ObservedCrashed && observed != ObservedBackoff && observed != ObservedCrashLoop
+	if alive && healthy {
+		if observed != ObservedRunning {
+			observeLaunch(hs.ID, nil)
+		}
+		since := getHoleInt(hs.ID, "running_since")
+		if restarts > 0 && now.Sub(time.Unix(since, 0)) > stableAfter {
+			usershole.holes.Set(hs.ID, "restarts", "0")
+		}
+		return ""
+	}
+
+	if _, isOrg := orgName(owner); !isOrg && IsSuspended(owner) {
+		return ""
+	}
+	if now.Unix() < getHoleInt(hs.ID, "next_start_at") {
+		state := ObservedBackoff
+		if restarts >= int64(crashLoopRestarts) {
+			state = ObservedCrashLoop
+		}
+		if observed != state {
+			usershole.holes.Set(hs.ID, "observed_state", state)
+		}
+		return ""
+	}
+
+	if alive {
+		os.Remove(configPath + hs.ID + ".json")
+	}
+	restarts++
+	setHoleInt(hs.ID, "restarts", restarts)
+	setHoleInt(hs.ID, "next_start_at", now.Add(restartBackoff(restarts)).Unix())
+	if err := hs.launch(); err != nil {
+		log.Println("controller: restart hole", hs.ID, "failed", err)
+		return ""
+	}
+	return "restarted hole"
+}
+
+// DriveHoles drives every owned hole toward its desired state.
+func DriveHoles() []string {
+	changes := make([]string, 0)
+	for holeID, owner := range holeOwners() {
+		hs := usershole.GetOne(owner, holeID)
+		if hs == nil {
+			continue
+		}
+		if change := DriveHole(owner, hs); change != "" {
+			log.Println("controller:", change, holeID)
+			changes = append(changes, change+" "+holeID)
+		}
+	}
+	return changes
+}
+
+func RunController() {
+	for {
+		time.Sleep(time.Duration(controllerInterval) * time.Second)
+		DriveHoles()
+	}
+}
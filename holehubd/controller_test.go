@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestHole creates and starts a hole of alice.
+func startTestHole(t *testing.T) *HoleApp {
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return hs
+}
+
+func observedState(holeID string) string {
+	state, _ := usershole.holes.Get(holeID, "observed_state")
+	return state
+}
+
+func TestDriveHoleStopped(t *testing.T) {
+	openTestStore(t)
+	hs := startTestHole(t)
+	if err := hs.Kill(); err != nil {
+		t.Fatal(err)
+	}
+
+	// holed still serves a launch file of a stopped hole.
+	if err := ioutil.WriteFile(configPath+hs.ID+".json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if change := DriveHole("alice", hs); change != "killed stopped hole" {
+		t.Fatal("controller", change)
+	}
+	if hs.Alive() {
+		t.Fatal("stopped hole still has a launch file")
+	}
+	if change := DriveHole("alice", hs); change != "" {
+		t.Fatal("controller", change)
+	}
+	if state := observedState(hs.ID); state != ObservedStopped {
+		t.Fatal("observed state is", state)
+	}
+}
+
+func TestDriveHoleRestart(t *testing.T) {
+	openTestStore(t)
+	hs := startTestHole(t)
+	if change := DriveHole("alice", hs); change != "" {
+		t.Fatal("controller", change, "a running hole")
+	}
+	if state := observedState(hs.ID); state != ObservedRunning {
+		t.Fatal("observed state is", state)
+	}
+
+	os.Remove(configPath + hs.ID + ".json")
+	if change := DriveHole("alice", hs); change != "restarted hole" {
+		t.Fatal("controller", change)
+	}
+	if !hs.Alive() || getHoleInt(hs.ID, "restarts") != 1 {
+		t.Fatal("hole not restarted")
+	}
+
+	HoleCrashed(hs.ID, "boom")
+	if change := DriveHole("alice", hs); change != "" {
+		t.Fatal("controller", change, "during the backoff")
+	}
+	if state := observedState(hs.ID); state != ObservedBackoff {
+		t.Fatal("observed state is", state)
+	}
+
+	for i := 2; i <= crashLoopRestarts; i++ {
+		setHoleInt(hs.ID, "next_start_at", 0)
+		if change := DriveHole("alice", hs); change != "restarted hole" {
+			t.Fatal("controller", change)
+		}
+		HoleCrashed(hs.ID, "boom")
+	}
+	DriveHole("alice", hs)
+	if state := observedState(hs.ID); state != ObservedCrashLoop {
+		t.Fatal("observed state is", state)
+	}
+	if last, _ := usershole.holes.Get(hs.ID, "last_error"); last != "boom" {
+		t.Fatal("last error is", last)
+	}
+
+	// Starting again forgets the restarts.
+	if err := hs.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if restarts := getHoleInt(hs.ID, "restarts"); restarts != 0 {
+		t.Fatal(restarts, "restarts after a start")
+	}
+}
+
+func TestDriveHoleStable(t *testing.T) {
+	openTestStore(t)
+	hs := startTestHole(t)
+	setHoleInt(hs.ID, "restarts", 3)
+	setHoleInt(hs.ID, "running_since", time.Now().Add(-stableAfter-time.Minute).Unix())
+	DriveHole("alice", hs)
+	if restarts := getHoleInt(hs.ID, "restarts"); restarts != 0 {
+		t.Fatal(restarts, "restarts of a stable hole")
+	}
+}
+
+func TestDriveHoleSuspended(t *testing.T) {
+	openTestStore(t)
+	hs := startTestHole(t)
+	userstate.SetBooleanField("alice", "suspended", true)
+	os.Remove(configPath + hs.ID + ".json")
+	if change := DriveHole("alice", hs); change != "" {
+		t.Fatal("controller", change, "a hole of a suspended user")
+	}
+	if hs.Alive() {
+		t.Fatal("hole of a suspended user restarted")
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	for restarts, want := range map[int64]time.Duration{
+		1:  restartMinBackoff,
+		2:  2 * restartMinBackoff,
+		4:  8 * restartMinBackoff,
+		20: restartMaxBackoff,
+	} {
+		if got := restartBackoff(restarts); got != want {
+			t.Error("backoff after "+strconv.FormatInt(restarts, 10)+" restarts is", got, "want", want)
+		}
+	}
+}
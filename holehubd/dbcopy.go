@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xyproto/pinterface"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A bolt IHashMap lists its owners but not their fields, so db copy copies
+// the fields holehubd is known to write.
+var holeFields = []string{"owner", "name", "scheme", "port", "ca", "cakey", "labels", "created_at", "updated_at",
+	"client", "heartbeat_at", "heartbeat_grace", "on_disconnect",
+	"desired_state", "observed_state", "restarts", "last_error", "next_start_at", "running_since"}
+
+var userFields = []string{"ca", "cakey", "cert", "certkey", "locale", "plan", "orgs", "webhooks", "export",
+	"password_token", "cert_expiry_notified", "suspended"}
+
+// copyFields returns the fields of owner in the hash map of src.
+type copyFields func(src pinterface.ICreator, owner string) []string
+
+func fixedFields(fields ...string) copyFields {
+	return func(pinterface.ICreator, string) []string {
+		return fields
+	}
+}
+
+func userCopyFields(src pinterface.ICreator, username string) []string {
+	fields := append([]string{}, userFields...)
+	for _, name := range LimitNames {
+		fields = append(fields, "limit_"+name)
+	}
+	return fields
+}
+
+func orgCopyFields(src pinterface.ICreator, name string) []string {
+	fields := []string{"created_by", "members", "cert_expiry_notified"}
+	orgs, _ := src.NewHashMap("orgs")
+	list, _ := orgs.Get(name, "members")
+	for _, member := range splitList(list) {
+		fields = append(fields, "role_"+member)
+	}
+	return fields
+}
+
+// connectionDaySets returns the names of the sets that index the
+// connection log of each hole by day.
+func connectionDaySets(src pinterface.ICreator) []string {
+	names := make([]string, 0)
+	index, _ := src.NewHashMap("connection_index")
+	holeIDs, _ := index.GetAll()
+	for _, holeID := range holeIDs {
+		data, _ := index.Get(holeID, "days")
+		var days []string
+		json.Unmarshal([]byte(data), &days)
+		for _, day := range days {
+			names = append(names, "connection_day:"+holeID+":"+day)
+		}
+	}
+	return names
+}
+
+func indexCopyFields(src pinterface.ICreator, owner string) []string {
+	fields := []string{"holes"}
+	index, _ := src.NewHashMap("hole_index")
+	holes, _ := src.NewHashMap("holes")
+	data, _ := index.Get(owner, "holes")
+	var ids []string
+	json.Unmarshal([]byte(data), &ids)
+	for _, holeID := range ids {
+		if name, _ := holes.Get(holeID, "name"); name != "" {
+			fields = append(fields, "name:"+name)
+		}
+	}
+	return fields
+}
+
+var copyHashMaps = []struct {
+	name   string
+	fields copyFields
+}{
+	{"holes", fixedFields(holeFields...)},
+	{"hole_index", indexCopyFields},
+	{"orgs", orgCopyFields},
+	{"outbox", fixedFields("to", "to_name", "subject", "text", "html", "status", "attempts", "next_at", "last_error", "created_at", "sent_at")},
+	{"usage_records", fixedFields(append([]string{"plan"}, usageFields...)...)},
+	{"invitations", fixedFields("created_by", "email", "org", "role", "uses_left", "expired_at")},
+	{"hole_stats", fixedFields(statsFields...)},
+	{"connection_log", fixedFields("entry")},
+	{"connection_index", fixedFields("days")},
+	{"webhooks", fixedFields("owner", "url", "events", "secret", "created_at")},
+	{"webhook_deliveries", fixedFields("webhook", "event", "payload", "status", "attempts", "next_at", "last_error", "response_code", "created_at", "delivered_at")},
+}
+
+var copySets = []string{"free_ports", "outbox_pending", "webhook_pending"}
+
+func copyHashMap(creator pinterface.ICreator, src, dst pinterface.IHashMap, fields copyFields) (int, error) {
+	owners, err := src.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	for _, owner := range owners {
+		for _, field := range fields(creator, owner) {
+			if ok, _ := src.Has(owner, field); !ok {
+				continue
+			}
+			value, _ := src.Get(owner, field)
+			if err := dst.Set(owner, field, value); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(owners), nil
+}
+
+func copyKeys(src, dst pinterface.IKeyValue, keys []string) error {
+	for _, key := range keys {
+		if value, _ := src.Get(key); value != "" {
+			if err := dst.Set(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importUser adds a user with an already hashed password.
+func importUser(dst pinterface.IUserState, username, hash, email string) {
+	if state, ok := dst.(*SQLUserState); ok {
+		state.addUserHash(username, hash, email)
+		return
+	}
+	dst.AddUser(username, "", email)
+	dst.Users().Set(username, "password", hash)
+}
+
+// copyUsers copies the accounts with their password hashes, the cookie
+// secret comes along since the sha256 hashes are salted with it.
+func copyUsers(src, dst pinterface.IUserState) (int, error) {
+	dst.SetCookieSecret(src.CookieSecret())
+	usernames, err := src.AllUsernames()
+	if err != nil {
+		return 0, err
+	}
+	unconfirmed, _ := src.AllUnconfirmedUsernames()
+	for _, username := range usernames {
+		hash, _ := src.PasswordHash(username)
+		email, _ := src.Email(username)
+		importUser(dst, username, hash, email)
+		if src.IsConfirmed(username) {
+			dst.MarkConfirmed(username)
+		}
+		if src.IsAdmin(username) {
+			dst.SetAdminStatus(username)
+		}
+	}
+	for _, username := range unconfirmed {
+		if code, _ := src.ConfirmationCode(username); code != "" {
+			dst.AddUnconfirmed(username, code)
+		}
+	}
+	if _, err := copyHashMap(src.Creator(), src.Users(), dst.Users(), userCopyFields); err != nil {
+		return 0, err
+	}
+	return len(usernames), nil
+}
+
+// userKeys returns the keys of the key values that are named by a field of
+// the users, like the email or the password reset token.
+func userKeys(src pinterface.IUserState, usernames []string, field string) []string {
+	keys := make([]string, 0)
+	for _, username := range usernames {
+		if value, _ := src.Users().Get(username, field); value != "" {
+			keys = append(keys, value)
+		}
+	}
+	return keys
+}
+
+// transferKeys returns the monthly transfer keys, the months are those of
+// the daily usage records.
+func transferKeys(src pinterface.ICreator) []string {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	records, _ := src.NewHashMap("usage_records")
+	owners, _ := records.GetAll()
+	for _, record := range owners {
+		i := strings.LastIndex(record, ":")
+		if i < 0 {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", record[i+1:])
+		if err != nil {
+			continue
+		}
+		key := transferKey(record[:i], day)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// copyStore copies every store of holehubd from src into the empty dst and
+// returns how many entries each store had.
+func copyStore(src, dst pinterface.IUserState) (map[string]int, error) {
+	counts := make(map[string]int)
+	from, to := src.Creator(), dst.Creator()
+
+	n, err := copyUsers(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	counts["users"] = n
+
+	for _, hm := range copyHashMaps {
+		s, _ := from.NewHashMap(hm.name)
+		d, _ := to.NewHashMap(hm.name)
+		n, err := copyHashMap(from, s, d, hm.fields)
+		if err != nil {
+			return nil, err
+		}
+		counts[hm.name] = n
+	}
+
+	for _, name := range append(copySets, connectionDaySets(from)...) {
+		s, _ := from.NewSet(name)
+		d, _ := to.NewSet(name)
+		values, _ := s.GetAll()
+		for _, value := range values {
+			if err := d.Add(value); err != nil {
+				return nil, err
+			}
+		}
+		counts[name] = len(values)
+	}
+
+	s, _ := from.NewList("audit")
+	d, _ := to.NewList("audit")
+	entries, _ := s.GetAll()
+	for _, entry := range entries {
+		if err := d.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	counts["audit"] = len(entries)
+
+	usernames, _ := src.AllUsernames()
+	emailKeys := make([]string, 0)
+	for _, username := range usernames {
+		if email, _ := src.Email(username); email != "" {
+			emailKeys = append(emailKeys, email)
+		}
+	}
+	keyValues := []struct {
+		name string
+		keys []string
+	}{
+		{"emails", emailKeys},
+		{"password_tokens", userKeys(src, usernames, "password_token")},
+		{"exports", userKeys(src, usernames, "export")},
+		{"usage", transferKeys(from)},
+		{"seq", []string{"holeserverport"}},
+		// meta goes last, a store with a schema version was fully copied.
+		{"meta", []string{"schema_version"}},
+	}
+	for _, kv := range keyValues {
+		s, _ := from.NewKeyValue(kv.name)
+		d, _ := to.NewKeyValue(kv.name)
+		if err := copyKeys(s, d, kv.keys); err != nil {
+			return nil, err
+		}
+		counts[kv.name] = len(kv.keys)
+	}
+	return counts, nil
+}
+
+func printCounts(counts map[string]int) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %d\n", name, counts[name])
+	}
+}
+
+// CopyStore copies the open store into the empty SQL store of backend.
+func CopyStore(backend, dsn string) error {
+	if backend == "bolt" {
+		return fmt.Errorf("db copy only copies into sqlite or postgres")
+	}
+	perm, err := OpenBackend(backend, dsn)
+	if err != nil {
+		return err
+	}
+	dst := perm.UserState()
+	defer dst.Host().Close()
+	if names, _ := dst.AllUsernames(); len(names) > 0 {
+		return fmt.Errorf("The %s store is not empty", backend)
+	}
+	counts, err := copyStore(userstate, dst)
+	if err != nil {
+		return err
+	}
+	printCounts(counts)
+	return nil
+}
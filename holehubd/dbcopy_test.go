@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCopyStore(t *testing.T) {
+	openTestStore(t)
+	userstate.AddUser("bob", "secret", "bob@example.com")
+	userstate.MarkConfirmed("bob")
+	userstate.SetAdminStatus("bob")
+	if err := CreateOrg("acme", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := usershole.NewHoleApp(OrgOwner("acme"), "api", "tcp", nil); err != nil {
+		t.Fatal(err)
+	}
+	LogConnection(hs.ID, ConnectionEntry{Remote: "10.0.0.1:1234", EndedAt: time.Now().Unix()})
+	if _, err := CreateWebhook("alice", "https://example.com/hook", []string{EventStarted}, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	QueueMail(&Mail{To: "bob@example.com", Subject: "Hello", Text: "Hi"})
+	Audit("alice", "hole.create", hs.ID, nil)
+	Audit("alice", "hole.start", hs.ID, nil)
+
+	dsn := filepath.Join(configPath, "copy.sqlite")
+	if err := CopyStore("sqlite", dsn); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyStore("sqlite", dsn); err == nil {
+		t.Fatal("copied into a store that is not empty")
+	}
+
+	perm, err := OpenBackend("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := perm.UserState()
+	defer dst.Host().Close()
+	if !dst.CorrectPassword("bob", "secret") || !dst.IsConfirmed("bob") || !dst.IsAdmin("bob") {
+		t.Fatal("bob was not copied with password and status")
+	}
+	creator := dst.Creator()
+	holes, _ := creator.NewHashMap("holes")
+	if name, _ := holes.Get(hs.ID, "name"); name != "web" {
+		t.Fatal("hole copied with name", name)
+	}
+	if labels, _ := holes.Get(hs.ID, "labels"); labels != `{"env":"prod"}` {
+		t.Fatal("hole copied with labels", labels)
+	}
+	index, _ := creator.NewHashMap("hole_index")
+	if ids, _ := index.Get("alice", "name:web"); ids != `["`+hs.ID+`"]` {
+		t.Fatal("name index copied as", ids)
+	}
+	orgs, _ := creator.NewHashMap("orgs")
+	if role, _ := orgs.Get("acme", "role_alice"); role != "owner" {
+		t.Fatal("org role copied as", role)
+	}
+	day, _ := creator.NewSet("connection_day:" + hs.ID + ":" + connectionDay(time.Now()))
+	if keys, _ := day.GetAll(); len(keys) != 1 {
+		t.Fatal("connection index copied with", keys)
+	}
+	audit, _ := creator.NewList("audit")
+	if entries, _ := audit.GetAll(); len(entries) != 2 {
+		t.Fatal(len(entries), "audit entries copied")
+	}
+	copied, _ := creator.NewKeyValue("meta")
+	if version, _ := copied.Get("schema_version"); version != strconv.Itoa(latestSchemaVersion()) {
+		t.Fatal("schema version copied as", version)
+	}
+	seq, _ := creator.NewKeyValue("seq")
+	if port, _ := seq.Get("holeserverport"); port == "" {
+		t.Fatal("port sequence not copied")
+	}
+}
+
+func TestSQLListAdd(t *testing.T) {
+	openTestStore(t)
+	list, _ := userstate.Creator().NewList("test")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := list.Add(strconv.Itoa(i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	values, _ := list.GetAll()
+	if len(values) != 50 {
+		t.Fatal(len(values), "values in the list, want 50")
+	}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if seen[value] {
+			t.Fatal(value, "listed twice")
+		}
+		seen[value] = true
+	}
+	if last, _ := list.GetLast(); last != values[len(values)-1] {
+		t.Fatal("last value is", last)
+	}
+}
+
+func TestSQLiteStoreInUse(t *testing.T) {
+	openTestStore(t)
+	if _, err := OpenBackend("sqlite", storeDSN); err == nil {
+		t.Fatal("SQLite store opened twice")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/unrolled/render"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventCreated            = "created"
+	EventStarted            = "started"
+	EventKilled             = "killed"
+	EventRemoved            = "removed"
+	EventCrashed            = "crashed"
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventMetrics            = "metrics"
+	EventCertExpiring       = "cert_expiring"
+)
+
+// reportedEvents are the events a hole server may report.
+var reportedEvents = []string{EventCrashed, EventClientConnected, EventClientDisconnected}
+
+type Event struct {
+	Type  string                 `json:"type"`
+	Hole  string                 `json:"hole"`
+	Owner string                 `json:"owner"`
+	Time  int64                  `json:"time"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+}
+
+// eventBufferSize is how many events a slow subscriber may lag behind
+// before events are dropped for it.
+const eventBufferSize = 64
+
+var eventBus = struct {
+	sync.Mutex
+	subscribers map[chan Event]bool
+}{subscribers: make(map[chan Event]bool)}
+
+func Subscribe() chan Event {
+	ch := make(chan Event, eventBufferSize)
+	eventBus.Lock()
+	eventBus.subscribers[ch] = true
+	eventBus.Unlock()
+	return ch
+}
+
+func Unsubscribe(ch chan Event) {
+	eventBus.Lock()
+	delete(eventBus.subscribers, ch)
+	eventBus.Unlock()
+}
+
+func Publish(event Event) {
+	// Webhook deliveries are queued before the subscribers get the event,
+	// so a full subscriber buffer can not lose them.
+	QueueWebhooks(event)
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	for ch := range eventBus.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// PublishHoleEvent publishes an event of the hole to the subscribers allowed
+// to see its owner.
+func PublishHoleEvent(eventType, holeID string, data map[string]interface{}) {
+	Publish(Event{
+		Type:  eventType,
+		Hole:  holeID,
+		Owner: HoleOwner(holeID),
+		Time:  time.Now().Unix(),
+		Data:  data,
+	})
+}
+
+// canSeeEvent tells if username may receive the event, that is the hole is
+// owned by the user or by one of the user's organizations.
+func canSeeEvent(username string, event Event) bool {
+	if event.Owner == username {
+		return true
+	}
+	if org, isOrg := orgName(event.Owner); isOrg {
+		return HasOrgRole(org, username, "viewer")
+	}
+	return false
+}
+
+// eventKeepAlive is how often an idle event stream is pinged, so proxies
+// keep it open and dead clients are found.
+var eventKeepAlive = 30 * time.Second
+
+// eventStream calls send with every event username may see, and ping when
+// no event was sent for eventKeepAlive, until one of them fails or done is
+// closed.
+func eventStream(username, holeID string, done <-chan struct{}, send func(Event) error, ping func() error) {
+	ch := Subscribe()
+	defer Unsubscribe(ch)
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		case event := <-ch:
+			if holeID != "" && event.Hole != holeID {
+				continue
+			}
+			if !canSeeEvent(username, event) {
+				continue
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sameOrigin allows the WebSockets opened without an Origin, like the ones
+// of the client, or by a page of holehubd itself. /api/events is signed in
+// with the session cookie, which the browser also sends along with a
+// WebSocket opened by any other site: this check is the only thing that
+// keeps other sites from reading the events of the user.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     sameOrigin,
+}
+
+func serveWebSocketEvents(w http.ResponseWriter, req *http.Request, username, holeID string) {
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Printf("Events: websocket upgrade failed: %s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	// A client that answers no ping for two keepalives is gone.
+	wait := 2 * eventKeepAlive
+	conn.SetReadDeadline(time.Now().Add(wait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wait))
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	eventStream(username, holeID, done, func(event Event) error {
+		conn.SetWriteDeadline(time.Now().Add(wait))
+		return conn.WriteJSON(event)
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wait))
+	})
+}
+
+func serveSSEEvents(w http.ResponseWriter, req *http.Request, username, holeID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(format string, args ...interface{}) error {
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	eventStream(username, holeID, req.Context().Done(), func(event Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return write("event: %s\ndata: %s\n\n", event.Type, data)
+	}, func() error {
+		return write(": keepalive\n\n")
+	})
+}
+
+func EventRoutes(router *mux.Router, r *render.Render) {
+	router.HandleFunc("/api/events", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		holeID := req.URL.Query().Get("hole")
+		if websocket.IsWebSocketUpgrade(req) {
+			serveWebSocketEvents(w, req, username, holeID)
+		} else {
+			serveSSEEvents(w, req, username, holeID)
+		}
+	}).Methods("GET")
+
+	router.HandleFunc("/api/report/holes/{holeID}/events/", func(w http.ResponseWriter, req *http.Request) {
+		if !reportAllowed(req) {
+			http.Error(w, "Permission denied!", http.StatusForbidden)
+			return
+		}
+		holeID := mux.Vars(req)["holeID"]
+		if ok, _ := usershole.holes.Exists(holeID); !ok {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		req.ParseForm()
+		eventType := req.Form.Get("type")
+		var known bool
+		for _, name := range reportedEvents {
+			if name == eventType {
+				known = true
+			}
+		}
+		if !known {
+			r.JSON(w, http.StatusOK, ErrorMessages[28])
+			return
+		}
+		var data map[string]interface{}
+		if reason := req.Form.Get("error"); reason != "" {
+			data = map[string]interface{}{"error": reason}
+		}
+		if eventType == EventCrashed {
+			HoleCrashed(holeID, req.Form.Get("error"))
+		}
+		PublishHoleEvent(eventType, holeID, data)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func subscriberCount() int {
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	return len(eventBus.subscribers)
+}
+
+// waitSubscribers waits for the event streams to unsubscribe.
+func waitSubscribers(t *testing.T, n int) {
+	for i := 0; i < 100 && subscriberCount() != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := subscriberCount(); count != n {
+		t.Fatalf("%d subscribers, want %d", count, n)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for origin, allowed := range map[string]bool{
+		"":                             true,
+		"https://hub.example.com":      true,
+		"https://HUB.example.com":      true,
+		"https://evil.example.com":     false,
+		"https://hub.example.com:8443": false,
+		"://":                          false,
+	} {
+		req := httptest.NewRequest("GET", "https://hub.example.com/api/events", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if sameOrigin(req) != allowed {
+			t.Errorf("origin %q allowed: %v, want %v", origin, !allowed, allowed)
+		}
+	}
+}
+
+func TestSSEEventsKeepAlive(t *testing.T) {
+	eventKeepAlive = 10 * time.Millisecond
+	defer func() { eventKeepAlive = 30 * time.Second }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/api/events", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	serveSSEEvents(w, req, "alice", "")
+
+	if !strings.Contains(w.Body.String(), ": keepalive\n\n") {
+		t.Error("no keepalive sent")
+	}
+	waitSubscribers(t, 0)
+}
+
+func TestWebSocketEvents(t *testing.T) {
+	eventKeepAlive = 20 * time.Millisecond
+	defer func() { eventKeepAlive = 30 * time.Second }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveWebSocketEvents(w, req, "alice", "")
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	header := http.Header{"Origin": {"https://evil.example.com"}}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("websocket of another origin opened")
+	}
+
+	// The client reads nothing, so it answers no ping and is dropped.
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitSubscribers(t, 1)
+	waitSubscribers(t, 0)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/xyproto/pinterface"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+var exports pinterface.IKeyValue
+
+var exportTTL = 24 * time.Hour
+
+type ExportJob struct {
+	Username  string `json:"username"`
+	Status    string `json:"status"`
+	ExpiredAt int64  `json:"expiredAt"`
+}
+
+func exportFile(token string) string {
+	return configPath + "exports/" + token + ".zip"
+}
+
+func GetExportJob(token string) (job ExportJob, ok bool) {
+	data, _ := exports.Get(token)
+	if data == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return
+	}
+	return job, true
+}
+
+func saveExportJob(token string, job ExportJob) {
+	data, _ := json.Marshal(job)
+	exports.Set(token, string(data))
+}
+
+// RemoveExport deletes the export job and its archive.
+func RemoveExport(token string) {
+	exports.Del(token)
+	os.Remove(exportFile(token))
+}
+
+// StartExport queues an export of everything stored about username and
+// returns the token of the download link. The archive is built in the
+// background and the link is emailed once it is ready.
+func StartExport(username string) (string, error) {
+	token, err := userstate.GenerateUniqueConfirmationCode()
+	if err != nil {
+		return "", err
+	}
+	users := userstate.Users()
+	if old, _ := users.Get(username, "export"); old != "" {
+		RemoveExport(old)
+	}
+	users.Set(username, "export", token)
+	saveExportJob(token, ExportJob{
+		Username:  username,
+		Status:    "pending",
+		ExpiredAt: time.Now().Add(exportTTL).Unix(),
+	})
+	go runExport(username, token)
+	return token, nil
+}
+
+func runExport(username, token string) {
+	job, _ := GetExportJob(token)
+	if err := writeExport(username, exportFile(token)); err != nil {
+		log.Println("export", username, "failed", err)
+		job.Status = "failed"
+		saveExportJob(token, job)
+		return
+	}
+	job.Status = "ready"
+	saveExportJob(token, job)
+	email, _ := userstate.Email(username)
+	SendExportLink(username, email, token)
+}
+
+// ResumeExports runs again, one after the other, the exports left pending
+// by a stop of holehubd, and drops the expired ones.
+func ResumeExports() {
+	usernames, _ := userstate.AllUsernames()
+	for _, username := range usernames {
+		token, _ := userstate.Users().Get(username, "export")
+		job, ok := GetExportJob(token)
+		if !ok || job.Status != "pending" {
+			continue
+		}
+		if job.ExpiredAt < time.Now().Unix() {
+			RemoveExport(token)
+			continue
+		}
+		log.Println("export", username, "resumed")
+		runExport(username, token)
+	}
+}
+
+// writeExport writes the archive next to fileName and moves it in place
+// once complete. It holds the certificates, so only holehubd may read it.
+func writeExport(username, fileName string) error {
+	os.MkdirAll(configPath+"exports", 0700)
+	tmpName := fileName + ".tmp"
+	fp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	defer fp.Close()
+	if err := writeExportZip(username, fp); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+func writeExportZip(username string, fp *os.File) error {
+	zw := zip.NewWriter(fp)
+
+	users := userstate.Users()
+	email, _ := userstate.Email(username)
+	profile := map[string]interface{}{
+		"username":  username,
+		"email":     email,
+		"confirmed": userstate.IsConfirmed(username),
+		"admin":     userstate.IsAdmin(username),
+	}
+
+	tokens := make([]map[string]string, 0)
+	if code, _ := users.Get(username, "password_token"); code != "" {
+		data, _ := passwordTokens.Get(code)
+		var token map[string]string
+		if json.Unmarshal([]byte(data), &token) == nil {
+			tokens = append(tokens, map[string]string{
+				"type":      "password_reset",
+				"expiredAt": token["expiredAt"],
+			})
+		}
+	}
+
+	sessions := []map[string]interface{}{
+		{"loggedIn": userstate.IsLoggedIn(username)},
+	}
+
+	files := map[string]interface{}{
+		"profile.json":  profile,
+		"holes.json":    usershole.GetAll(username),
+		"tokens.json":   tokens,
+		"sessions.json": sessions,
+		"audit.json":    AuditEntries(AuditFilter{User: username}),
+	}
+	for name, v := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(v, "", "  ")
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	// Only the public halves of the certificates are exported.
+	for _, name := range []string{"ca.pem", "cert.pem"} {
+		data, err := ioutil.ReadFile(configPath + "certs/" + username + "-" + name)
+		if err != nil {
+			continue
+		}
+		w, err := zw.Create("certs/" + name)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+	}
+
+	return zw.Close()
+}
+
+func exportFileName(job ExportJob) string {
+	return fmt.Sprintf("holehub-%s.zip", job.Username)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteExport(t *testing.T) {
+	openTestStore(t)
+	fileName := exportFile("token")
+	if err := writeExport("alice", fileName); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("export mode is %o, want 600", perm)
+	}
+	if _, err := os.Stat(fileName + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary export left behind")
+	}
+	zr, err := zip.OpenReader(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 5 {
+		t.Errorf("%d files exported, want 5", len(zr.File))
+	}
+}
+
+func TestResumeExports(t *testing.T) {
+	openTestStore(t)
+	userstate.AddUser("bob", "secret", "bob@example.com")
+	users := userstate.Users()
+	users.Set("alice", "export", "pending")
+	saveExportJob("pending", ExportJob{Username: "alice", Status: "pending", ExpiredAt: time.Now().Add(exportTTL).Unix()})
+	users.Set("bob", "export", "expired")
+	saveExportJob("expired", ExportJob{Username: "bob", Status: "pending", ExpiredAt: time.Now().Add(-time.Hour).Unix()})
+
+	ResumeExports()
+	if _, ok := GetExportJob("expired"); ok {
+		t.Error("expired export kept")
+	}
+	if job, _ := GetExportJob("pending"); job.Status != "ready" {
+		t.Fatal("resumed export is", job.Status)
+	}
+	if _, err := os.Stat(exportFile("pending")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The client of a started hole sends a heartbeat every 30 seconds. A hole
+// without one for its grace period is marked disconnected and, when its
+// policy says so, killed.
+var heartbeatGrace int
+var onDisconnect string
+var heartbeatInterval = 15 * time.Second
+
+const (
+	ClientConnected    = "connected"
+	ClientDisconnected = "disconnected"
+
+	DisconnectKeep = "keep"
+	DisconnectKill = "kill"
+)
+
+const minHeartbeatGrace = 10
+
+func validPolicy(action string, grace int) bool {
+	return (action == DisconnectKeep || action == DisconnectKill) && grace >= minHeartbeatGrace
+}
+
+// HolePolicy returns what to do with the hole once its client is gone and
+// after how many seconds, falling back to --on_disconnect and
+// --heartbeat_grace.
+func HolePolicy(holeID string) (string, int) {
+	action, _ := usershole.holes.Get(holeID, "on_disconnect")
+	if action == "" {
+		action = onDisconnect
+	}
+	value, _ := usershole.holes.Get(holeID, "heartbeat_grace")
+	grace, err := strconv.Atoi(value)
+	if err != nil {
+		grace = heartbeatGrace
+	}
+	return action, grace
+}
+
+func SetHolePolicy(holeID, action string, grace int) {
+	usershole.holes.Set(holeID, "on_disconnect", action)
+	usershole.holes.Set(holeID, "heartbeat_grace", strconv.Itoa(grace))
+	touchHole(holeID)
+}
+
+// Heartbeat records that the client of the hole is alive.
+func Heartbeat(hs *HoleApp) {
+	usershole.holes.Set(hs.ID, "heartbeat_at", strconv.FormatInt(time.Now().Unix(), 10))
+	if state, _ := usershole.holes.Get(hs.ID, "client"); state != ClientConnected {
+		usershole.holes.Set(hs.ID, "client", ClientConnected)
+		PublishHoleEvent(EventClientConnected, hs.ID, nil)
+	}
+}
+
+// disconnectHole marks the hole disconnected, tells its owner and applies
+// the policy of the hole.
+func disconnectHole(hs *HoleApp, owner, action string) {
+	usershole.holes.Set(hs.ID, "client", ClientDisconnected)
+	PublishHoleEvent(EventClientDisconnected, hs.ID, nil)
+	log.Println("hole", hs.ID, "of", owner, "lost its client")
+	if _, isOrg := orgName(owner); !isOrg {
+		if email, _ := userstate.Email(owner); email != "" {
+			SendHoleDown(owner, email, hs)
+		}
+	}
+	if action == DisconnectKill {
+		hs.Kill()
+		Audit("holehubd", "hole.kill", hs.ID, nil)
+	}
+}
+
+// CheckHeartbeats disconnects the started holes whose client missed its
+// heartbeats for longer than the grace period.
+func CheckHeartbeats() {
+	now := time.Now().Unix()
+	holeIDs, _ := usershole.holes.GetAll()
+	for _, holeID := range holeIDs {
+		if state, _ := usershole.holes.Get(holeID, "client"); state == ClientDisconnected {
+			continue
+		}
+		value, _ := usershole.holes.Get(holeID, "heartbeat_at")
+		heartbeat, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		action, grace := HolePolicy(holeID)
+		if now-heartbeat <= int64(grace) {
+			continue
+		}
+		owner := HoleOwner(holeID)
+		hs := usershole.GetOne(owner, holeID)
+		if hs == nil || !hs.IsAlive {
+			continue
+		}
+		disconnectHole(hs, owner, action)
+	}
+}
+
+func RunHeartbeatWatch() {
+	for {
+		CheckHeartbeats()
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// heartbeatHandler records a heartbeat of the hole found by getHole.
+func heartbeatHandler(r *render.Render, getHole func(req *http.Request) *HoleApp) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		hs := getHole(req)
+		if hs == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		Heartbeat(hs)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}
+}
+
+// policyHandler sets the disconnect policy of the hole found by getHole.
+func policyHandler(r *render.Render, getHole func(req *http.Request) *HoleApp) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		hs := getHole(req)
+		if hs == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		req.ParseForm()
+		action, grace := HolePolicy(hs.ID)
+		if value := req.Form.Get("on_disconnect"); value != "" {
+			action = value
+		}
+		if value := req.Form.Get("grace"); value != "" {
+			var err error
+			if grace, err = strconv.Atoi(value); err != nil {
+				grace = 0
+			}
+		}
+		if !validPolicy(action, grace) {
+			r.JSON(w, http.StatusOK, ErrorMessages[33])
+			return
+		}
+		SetHolePolicy(hs.ID, action, grace)
+		Audit(userstate.Username(req), "hole.policy", hs.ID, req)
+		hs.loadState()
+		r.JSON(w, http.StatusOK, hs)
+	}
+}
+
+func HeartbeatRoutes(router *mux.Router, r *render.Render) {
+	userHole := func(req *http.Request) *HoleApp {
+		return usershole.GetOne(userstate.Username(req), mux.Vars(req)["holeID"])
+	}
+	orgHole := func(req *http.Request) *HoleApp {
+		vars := mux.Vars(req)
+		if !HasOrgRole(vars["org"], userstate.Username(req), "member") {
+			return nil
+		}
+		return usershole.GetOne(OrgOwner(vars["org"]), vars["holeID"])
+	}
+
+	router.HandleFunc("/api/holes/{holeID}/heartbeat/", heartbeatHandler(r, userHole)).Methods("POST")
+	router.HandleFunc("/api/orgs/{org}/holes/{holeID}/heartbeat/", heartbeatHandler(r, orgHole)).Methods("POST")
+	router.HandleFunc("/api/holes/{holeID}/policy/", policyHandler(r, userHole)).Methods("POST")
+	router.HandleFunc("/api/orgs/{org}/holes/{holeID}/policy/", policyHandler(r, orgHole)).Methods("POST")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func clientState(holeID string) string {
+	state, _ := usershole.holes.Get(holeID, "client")
+	return state
+}
+
+// missHeartbeats sets the last heartbeat of the hole past its grace.
+func missHeartbeats(holeID string) {
+	_, grace := HolePolicy(holeID)
+	usershole.holes.Set(holeID, "heartbeat_at", strconv.FormatInt(time.Now().Unix()-int64(grace)-1, 10))
+}
+
+func TestCheckHeartbeatsKeep(t *testing.T) {
+	openTestStore(t)
+	heartbeatGrace = 60
+	onDisconnect = DisconnectKeep
+	hs := startTestHole(t)
+	Heartbeat(hs)
+	if state := clientState(hs.ID); state != ClientConnected {
+		t.Fatal("client is", state)
+	}
+
+	CheckHeartbeats()
+	if state := clientState(hs.ID); state != ClientConnected {
+		t.Fatal("client with a fresh heartbeat is", state)
+	}
+
+	ch := Subscribe()
+	defer Unsubscribe(ch)
+	missHeartbeats(hs.ID)
+	CheckHeartbeats()
+	if state := clientState(hs.ID); state != ClientDisconnected {
+		t.Fatal("client is", state)
+	}
+	if !hs.Alive() {
+		t.Fatal("hole killed with the keep policy")
+	}
+	select {
+	case event := <-ch:
+		if event.Type != EventClientDisconnected || event.Hole != hs.ID {
+			t.Fatal("published", event)
+		}
+	default:
+		t.Fatal("no client_disconnected event")
+	}
+
+	Heartbeat(hs)
+	if state := clientState(hs.ID); state != ClientConnected {
+		t.Fatal("client is", state, "after a heartbeat")
+	}
+}
+
+func TestCheckHeartbeatsKill(t *testing.T) {
+	openTestStore(t)
+	heartbeatGrace = 60
+	onDisconnect = DisconnectKeep
+	hs := startTestHole(t)
+	SetHolePolicy(hs.ID, DisconnectKill, minHeartbeatGrace)
+	Heartbeat(hs)
+
+	missHeartbeats(hs.ID)
+	CheckHeartbeats()
+	if hs.Alive() {
+		t.Fatal("hole kept with the kill policy")
+	}
+	if state, _ := usershole.holes.Get(hs.ID, "desired_state"); state != DesiredStopped {
+		t.Fatal("desired state is", state)
+	}
+}
+
+func TestValidPolicy(t *testing.T) {
+	for _, c := range []struct {
+		action string
+		grace  int
+		valid  bool
+	}{
+		{DisconnectKeep, minHeartbeatGrace, true},
+		{DisconnectKill, 300, true},
+		{DisconnectKill, minHeartbeatGrace - 1, false},
+		{"remove", 300, false},
+	} {
+		if validPolicy(c.action, c.grace) != c.valid {
+			t.Error("policy", c.action, c.grace, "valid:", !c.valid)
+		}
+	}
+}
@@ -13,10 +13,8 @@ import (
 	"github.com/mholt/binding"
 	e "github.com/pjebs/jsonerror"
 	"github.com/satori/go.uuid"
-	"github.com/sendgrid/sendgrid-go"
 	"github.com/tylerb/graceful"
 	"github.com/unrolled/render"
-	permissions "github.com/xyproto/permissionbolt"
 	"github.com/xyproto/pinterface"
 	"github.com/zimmski/negroni-cors"
 	"io/ioutil"
@@ -26,7 +24,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
-	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -37,7 +35,14 @@ var host string
 var configPath string
 var tplFile = "config.tpl"
 var port int
-var sg *sendgrid.SGClient
+var adminName string
+var mailer Mailer
+var mailerConf MailerConfig
+
+var userstate pinterface.IUserState
+var emails pinterface.IKeyValue
+var passwordTokens pinterface.IKeyValue
+var usershole *UsersHole
 
 var ErrorMessages = map[int]map[string]string{
 	0:  e.New(0, "", "Success").Render(),
@@ -51,14 +56,58 @@ var ErrorMessages = map[int]map[string]string{
 	8:  e.New(8, "Old password is not correct.", "").Render(),
 	9:  e.New(9, "PasswordToken is expired.", "").Render(),
 	10: e.New(10, "HoleApp is not exists.", "").Render(),
+	11: e.New(11, "Password is not correct.", "Please confirm with your current password.").Render(),
+	12: e.New(12, "Export is not ready or expired.", "").Render(),
+	13: e.New(13, "Locale format error", "Please use a locale like en_US.").Render(),
+	14: e.New(14, "Mail is not exists.", "").Render(),
+	15: e.New(15, "Limit format error", "Please use an integer.").Render(),
+	16: e.New(16, "User is suspended.", "Please contact the administrator.").Render(),
+	17: e.New(17, "Quota exceeded.", "The limit is reached.").Render(),
+	18: e.New(18, "Billing period format error", "Please use a month like 2006-01.").Render(),
+	19: e.New(19, "Plan is not exists.", "").Render(),
+	20: e.New(20, "Organization is already exists.", "Please try a new one.").Render(),
+	21: e.New(21, "Organization is not exists.", "").Render(),
+	22: e.New(22, "Permission denied.", "Your role in the organization does not allow this.").Render(),
+	23: e.New(23, "Organization name format error", "Please use letters, digits, - and _.").Render(),
+	24: e.New(24, "Role is not exists.", "Please use viewer, member, admin or owner.").Render(),
+	25: e.New(25, "Invitation is invalid or expired.", "Please ask for a new invitation.").Render(),
+	26: e.New(26, "Signup is closed for this email domain.", "Please ask for an invitation.").Render(),
+	27: e.New(27, "Stats step is not exists.", "Please use minute, hour or day.").Render(),
+	28: e.New(28, "Event type is not exists.", "Please use crashed, client_connected or client_disconnected.").Render(),
+	29: e.New(29, "Webhook is not exists.", "Please check the webhook id.").Render(),
+	30: e.New(30, "Webhook url format error.", "Please use a http or https url.").Render(),
+	31: e.New(31, "Webhook event is not exists.", "Please use started, killed, crashed, client_connected, client_disconnected or cert_expiring.").Render(),
+	32: e.New(32, "Webhook delivery is not exists.", "Please check the delivery id.").Render(),
+	33: e.New(33, "Disconnect policy format error.", "Please use keep or kill and a grace of at least 10 seconds.").Render(),
+	34: e.New(34, "Labels format error.", "Please use key=value,key=value with keys of letters, digits, -, _ or .").Render(),
+	35: e.New(35, "Backup failed.", "Please check the server logs.").Render(),
+	36: e.New(36, "Hole name exists.", "Please choose another name or remove the other hole.").Render(),
+	37: e.New(37, "Hole name is not unique.", "Several holes have this name, please use the hole ID.").Render(),
+	38: e.New(38, "Username format error.", "Please use letters, digits, -, _ and . without the org- prefix.").Render(),
+	39: e.New(39, "Stats range error.", "Please use a from before to.").Render(),
+	40: e.New(40, "Webhook url is not allowed.", "Please use a url of a public address.").Render(),
+	41: e.New(41, "HoleApp start failed.", "").Render(),
+	42: e.New(42, "Organization needs an owner.", "Please make another member owner first.").Render(),
+}
+
+// errorMessage returns a copy of ErrorMessages[code] with the message set.
+func errorMessage(code int, message string) map[string]string {
+	msg := make(map[string]string)
+	for k, v := range ErrorMessages[code] {
+		msg[k] = v
+	}
+	msg["message"] = message
+	return msg
 }
 
-var reEmail, _ = regexp.Compile("(\\w[-._\\w]*\\w@\\w[-._\\w]*\\w\\.\\w{2,3})")
+var reEmail, _ = regexp.Compile("^\\w[-._\\w]*\\w@\\w[-._\\w]*\\w\\.\\w{2,}$")
 
 type NewUserForm struct {
-	Name     string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Name       string `json:"username"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	Locale     string `json:"locale"`
+	Invitation string `json:"invitation"`
 }
 
 func (uf *NewUserForm) FieldMap(_ *http.Request) binding.FieldMap {
@@ -75,6 +124,14 @@ func (uf *NewUserForm) FieldMap(_ *http.Request) binding.FieldMap {
 			Form:     "password",
 			Required: true,
 		},
+		&uf.Locale: binding.Field{
+			Form:     "locale",
+			Required: false,
+		},
+		&uf.Invitation: binding.Field{
+			Form:     "invitation",
+			Required: false,
+		},
 	}
 }
 
@@ -198,48 +255,62 @@ func GenerateUserCert(username string) {
 }
 
 func SendConfirmationCode(username, email, confirmationCode string) bool {
-	message := sendgrid.NewMail()
-	message.AddTo(email)
-	message.AddToName(username)
-	message.SetSubject("欢迎注册 HoleHUB")
-	message.SetText("Hi，欢迎加入HoleHUB！\n\n在这里您可以方便地穿透路由器。\n\n为了保障该帐号可以正常使用，请于24小时内点击以下链接验证您的账号:\nhttp://holehub.com/api/confirm/" + confirmationCode)
-	message.SetFrom("support@holehub.com")
-	message.SetFromName("HoleHUB Support")
-	if r := sg.Send(message); r == nil {
-		fmt.Println("Email sent!")
-		return true
-	} else {
-		fmt.Println(r)
-		return false
-	}
+	return SendTemplateMail(username, email, "confirmation", map[string]interface{}{
+		"Code": confirmationCode,
+	})
 }
 
 func SendPasswordToken(username, email, token string) bool {
-	message := sendgrid.NewMail()
-	message.AddTo(email)
-	message.AddToName(username)
-	message.SetSubject("HoleHUB 重置密码")
-	message.SetText("如果非本人操作请忽略此邮件。\n\n请在 12 小时内完成重置密码:\nhttp://holehub.com/reset_password/?token=" + token)
-	message.SetFrom("support@holehub.com")
-	message.SetFromName("HoleHUB Support")
-	if r := sg.Send(message); r == nil {
-		fmt.Println("Email sent!")
-		return true
-	} else {
-		fmt.Println(r)
-		return false
-	}
+	return SendTemplateMail(username, email, "password_token", map[string]interface{}{
+		"Token": token,
+	})
+}
+
+func SendExportLink(username, email, token string) bool {
+	return SendTemplateMail(username, email, "export", map[string]interface{}{
+		"Token": token,
+	})
+}
+
+func SendInvitation(inviter, email string, inv *Invitation) bool {
+	return SendTemplateMail("", email, "invitation", map[string]interface{}{
+		"Inviter":    inviter,
+		"Invitation": inv,
+	})
+}
+
+func SendHoleDown(username, email string, hs *HoleApp) bool {
+	return SendTemplateMail(username, email, "hole_down", map[string]interface{}{
+		"Hole": hs,
+	})
+}
+
+func SendCertExpiry(username, email string, notAfter time.Time) bool {
+	return SendTemplateMail(username, email, "cert_expiry", map[string]interface{}{
+		"NotAfter": notAfter.Format("2006-01-02"),
+	})
 }
 
 type HoleApp struct {
-	ID      string
-	Name    string
-	Scheme  string
-	Host    string
-	Port    string
-	Ca      string `json:"-"`
-	Cakey   string `json:"-"`
-	IsAlive bool   `json:"Alive"`
+	ID            string
+	Name          string
+	Scheme        string
+	Host          string
+	Port          string
+	Ca            string `json:"-"`
+	Cakey         string `json:"-"`
+	IsAlive       bool   `json:"Alive"`
+	Client        string `json:",omitempty"`
+	Heartbeat     int64  `json:",omitempty"`
+	OnDisconnect  string
+	Grace         int
+	DesiredState  string
+	ObservedState string
+	Restarts      int64
+	LastError     string `json:",omitempty"`
+	Labels        map[string]string
+	CreatedAt     int64
+	UpdatedAt     int64
 }
 
 func NewHoleApp(ID, name, scheme, port, ca, cakey string) *HoleApp {
@@ -256,20 +327,64 @@ func NewHoleApp(ID, name, scheme, port, ca, cakey string) *HoleApp {
 	return hs
 }
 
+// Start marks the hole to be running and writes its launch file.
 func (h *HoleApp) Start() error {
+	defer lockHole(h.ID)()
+	if !holeExists(h.ID) {
+		return errHoleRemoved
+	}
+	setDesiredState(h.ID, DesiredRunning)
+	return h.launch()
+}
+
+// launch writes the launch file holed serves the hole from.
+func (h *HoleApp) launch() error {
+	if h.Alive() {
+		holeStarts.Inc("restart")
+	} else {
+		holeStarts.Inc("start")
+	}
 	fp, err := os.Create(configPath + h.ID + ".json")
 	if err != nil {
+		observeLaunch(h.ID, err)
 		return err
 	}
+	defer fp.Close()
+	usershole.holes.Set(h.ID, "heartbeat_at", strconv.FormatInt(time.Now().Unix(), 10))
+	usershole.holes.DelKey(h.ID, "client")
 	var tpl = template.Must(template.ParseFiles(configPath + tplFile))
 	err = tpl.Execute(fp, h)
 	h.IsAlive = true
+	observeLaunch(h.ID, err)
+	if err == nil {
+		PublishHoleEvent(EventStarted, h.ID, nil)
+	}
 	return err
 }
 
+// Kill marks the hole to be stopped and removes its launch file.
 func (h *HoleApp) Kill() error {
+	defer lockHole(h.ID)()
+	if !holeExists(h.ID) {
+		return errHoleRemoved
+	}
+	return h.kill()
+}
+
+// kill is Kill for a caller holding lockHole.
+func (h *HoleApp) kill() error {
+	setDesiredState(h.ID, DesiredStopped)
+	return h.unlaunch()
+}
+
+func (h *HoleApp) unlaunch() error {
 	h.IsAlive = false
-	return os.Remove(configPath + h.ID + ".json")
+	usershole.holes.Set(h.ID, "observed_state", ObservedStopped)
+	err := os.Remove(configPath + h.ID + ".json")
+	if err == nil {
+		PublishHoleEvent(EventKilled, h.ID, nil)
+	}
+	return err
 }
 
 func (h *HoleApp) Alive() bool {
@@ -280,11 +395,36 @@ func (h *HoleApp) Alive() bool {
 	return false
 }
 
+// loadState refreshes the fields that change while the hole is cached.
+func (h *HoleApp) loadState() {
+	h.IsAlive = h.Alive()
+	h.Client, _ = usershole.holes.Get(h.ID, "client")
+	heartbeat, _ := usershole.holes.Get(h.ID, "heartbeat_at")
+	h.Heartbeat, _ = strconv.ParseInt(heartbeat, 10, 64)
+	h.OnDisconnect, h.Grace = HolePolicy(h.ID)
+	h.DesiredState, _ = usershole.holes.Get(h.ID, "desired_state")
+	h.ObservedState, _ = usershole.holes.Get(h.ID, "observed_state")
+	h.Restarts = getHoleInt(h.ID, "restarts")
+	h.LastError, _ = usershole.holes.Get(h.ID, "last_error")
+	labels, _ := usershole.holes.Get(h.ID, "labels")
+	h.Labels = decodeLabels(labels)
+	h.UpdatedAt = getHoleInt(h.ID, "updated_at")
+}
+
+// UsersHole is the registry of holes. Handlers, the controller and the
+// background loops use it concurrently, so lock guards the cache in servers.
+// Writes to the hole indexes and the port allocator also take the "holes"
+// store lock, other holehubd may share the store. The holes it returns are
+// copies that callers may change freely.
 type UsersHole struct {
-	state   pinterface.IUserState
-	holes   pinterface.IHashMap
-	seq     pinterface.IKeyValue
-	servers map[string]*HoleApp
+	state     pinterface.IUserState
+	holes     pinterface.IHashMap
+	index     pinterface.IHashMap
+	seq       pinterface.IKeyValue
+	freePorts pinterface.ISet
+	orgs      pinterface.IHashMap
+	servers   map[string]*HoleApp
+	lock      sync.Mutex
 }
 
 func NewUsersHole(state pinterface.IUserState) *UsersHole {
@@ -292,102 +432,177 @@ func NewUsersHole(state pinterface.IUserState) *UsersHole {
 	creator := state.Creator()
 	uh.state = state
 	uh.holes, _ = creator.NewHashMap("holes")
+	uh.index, _ = creator.NewHashMap("hole_index")
 	uh.seq, _ = creator.NewKeyValue("seq")
+	uh.freePorts, _ = creator.NewSet("free_ports")
+	uh.orgs, _ = creator.NewHashMap("orgs")
 	uh.servers = make(map[string]*HoleApp)
 	return uh
 }
 
-func (h *UsersHole) NewHoleApp(username, holeName, scheme string) *HoleApp {
-	if !h.state.HasUser(username) {
-		return nil
+// ownerRecord returns where the record of owner is kept. owner is a user
+// name, or org:<name> for an organization.
+func (h *UsersHole) ownerRecord(owner string) (record pinterface.IHashMap, key string, ok bool) {
+	if name, isOrg := orgName(owner); isOrg {
+		ok, _ = h.orgs.Exists(name)
+		return h.orgs, name, ok
 	}
-	users := h.state.Users()
-	port := strconv.Itoa(h.GetLastPort())
-	ca := username + "-ca.pem"
-	cakey := username + "-ca.key"
-	holeID := uuid.NewV4().String()
-	h.holes.Set(holeID, "name", holeName)
-	h.holes.Set(holeID, "ca", ca)
-	h.holes.Set(holeID, "cakey", cakey)
+	return h.state.Users(), owner, h.state.HasUser(owner)
+}
+
+// snapshot returns a copy of the cached hole with its state refreshed.
+func snapshot(hs *HoleApp) *HoleApp {
+	cp := *hs
+	cp.loadState()
+	return &cp
+}
+
+// lockWrite takes the "holes" store lock and then lock, for the writes to
+// the indexes and the ports. It returns the unlock of both.
+func (h *UsersHole) lockWrite() func() {
+	unlock := lockStore("holes")
+	h.lock.Lock()
+	return func() {
+		h.lock.Unlock()
+		unlock()
+	}
+}
 
+// NewHoleApp creates a hole of owner. Names are unique per owner, an empty
+// name is not checked.
+func (h *UsersHole) NewHoleApp(owner, holeName, scheme string, labels map[string]string) (*HoleApp, error) {
+	unlock := h.lockWrite()
+	if _, _, ok := h.ownerRecord(owner); !ok {
+		unlock()
+		return nil, fmt.Errorf("Owner is not exists")
+	}
+	if holeName != "" && len(h.indexList(owner, "name:"+holeName)) > 0 {
+		unlock()
+		return nil, errHoleNameExists
+	}
 	if scheme == "" {
 		scheme = "tcp"
 	}
+	rec := &HoleRecord{
+		ID:     uuid.NewV4().String(),
+		Owner:  owner,
+		Name:   holeName,
+		Scheme: scheme,
+		Port:   strconv.Itoa(h.nextPort()),
+		Ca:     certName(owner) + "-ca.pem",
+		Cakey:  certName(owner) + "-ca.key",
+		Labels: labels,
+	}
+	h.saveRecord(rec)
+	h.indexAdd(owner, holeName, rec.ID)
+	hs := h.cached(rec.ID)
+	unlock()
+
+	PublishHoleEvent(EventCreated, rec.ID, map[string]interface{}{"name": holeName})
+	return snapshot(hs), nil
+}
 
-	h.holes.Set(holeID, "scheme", scheme)
-	h.holes.Set(holeID, "port", port)
-	userholes, _ := users.Get(username, "holes")
-	users.Set(username, "holes", userholes+holeID+",")
-	hs := NewHoleApp(holeID, holeName, scheme, port, ca, cakey)
-	h.servers[holeID] = hs
+// cached returns the cached hole, loading it from the store the first
+// time. The caller holds lock.
+func (h *UsersHole) cached(holeID string) *HoleApp {
+	hs, ok := h.servers[holeID]
+	if !ok {
+		rec := h.GetRecord(holeID)
+		if rec == nil {
+			rec = &HoleRecord{ID: holeID}
+		}
+		hs = NewHoleApp(holeID, rec.Name, rec.Scheme, rec.Port, rec.Ca, rec.Cakey)
+		hs.CreatedAt = rec.CreatedAt
+		h.servers[holeID] = hs
+	}
 	return hs
 }
 
-func (h *UsersHole) GetAll(username string) []*HoleApp {
-	if !h.state.HasUser(username) {
+func (h *UsersHole) GetAll(owner string) []*HoleApp {
+	h.lock.Lock()
+	if _, _, ok := h.ownerRecord(owner); !ok {
+		h.lock.Unlock()
 		return nil
 	}
-	users := h.state.Users()
-	userholes, _ := users.Get(username, "holes")
-	holeIDs := strings.Split(userholes, ",")
-	servers := make([]*HoleApp, 0)
-	var ok bool
-	var server *HoleApp
-	for _, holeID := range holeIDs {
-		if holeID == "" {
-			continue
-		}
-		if server, ok = h.servers[holeID]; !ok {
-			port, _ := h.holes.Get(holeID, "port")
-			holeName, _ := h.holes.Get(holeID, "name")
-			scheme, _ := h.holes.Get(holeID, "scheme")
-			ca, _ := h.holes.Get(holeID, "ca")
-			cakey, _ := h.holes.Get(holeID, "cakey")
-			server := NewHoleApp(holeID, holeName, scheme, port, ca, cakey)
-			h.servers[holeID] = server
-		}
-		servers = append(servers, server)
+	cached := make([]*HoleApp, 0)
+	for _, holeID := range h.indexList(owner, "holes") {
+		cached = append(cached, h.cached(holeID))
+	}
+	h.lock.Unlock()
+
+	servers := make([]*HoleApp, 0, len(cached))
+	for _, hs := range cached {
+		servers = append(servers, snapshot(hs))
 	}
 	return servers
 }
 
-func (h *UsersHole) Remove(username, holeID string) error {
-	hs := h.GetOne(username, holeID)
-	if hs == nil {
+func (h *UsersHole) Remove(owner, holeID string) error {
+	unlock := h.lockWrite()
+	if !h.owns(owner, holeID) {
+		unlock()
 		return fmt.Errorf("HoleApp is not exists")
 	}
-	hs.Kill()
+	hs := snapshot(h.cached(holeID))
+	h.indexRemove(owner, hs.Name, holeID)
 	delete(h.servers, holeID)
+	unlock()
+
+	unlockHole := lockHole(holeID)
+	hs.kill()
+	PublishHoleEvent(EventRemoved, holeID, nil)
 	h.holes.Del(holeID)
-	users := h.state.Users()
-	userholes, _ := users.Get(username, "holes")
-	users.Set(username, "holes", strings.Replace(userholes, holeID+",", "", 1))
+	unlockHole()
+	forgetOpenConnections(holeID)
+	forgetHoleBytes(holeID)
+	h.FreePort(hs.Port)
 	return nil
 }
 
-func (h *UsersHole) GetOne(username, holeID string) *HoleApp {
-	if !h.state.HasUser(username) {
+func (h *UsersHole) GetOne(owner, holeID string) *HoleApp {
+	h.lock.Lock()
+	if !h.owns(owner, holeID) {
+		h.lock.Unlock()
 		return nil
 	}
-	users := h.state.Users()
-	userholes, _ := users.Get(username, "holes")
-	if !strings.Contains(userholes, holeID) {
-		return nil
+	hs := h.cached(holeID)
+	h.lock.Unlock()
+	return snapshot(hs)
+}
+
+// RemoveAll kills and removes every hole of owner.
+func (h *UsersHole) RemoveAll(owner string) {
+	for _, holeID := range h.HoleIDs(owner) {
+		if err := h.Remove(owner, holeID); err != nil {
+			log.Println("remove hole", holeID, "failed", err)
+		}
 	}
-	hs, ok := h.servers[holeID]
-	if !ok {
-		port, _ := h.holes.Get(holeID, "port")
-		holeName, _ := h.holes.Get(holeID, "name")
-		scheme, _ := h.holes.Get(holeID, "scheme")
-		ca, _ := h.holes.Get(holeID, "ca")
-		cakey, _ := h.holes.Get(holeID, "cakey")
-		hs := NewHoleApp(holeID, holeName, scheme, port, ca, cakey)
-		h.servers[holeID] = hs
+}
+
+// FreePort gives a port back so the next hole can reuse it.
+func (h *UsersHole) FreePort(port string) {
+	if port == "" {
+		return
 	}
-	return hs
+	unlock := h.lockWrite()
+	h.freePorts.Add(port)
+	unlock()
 }
 
 func (h *UsersHole) GetLastPort() int {
+	defer h.lockWrite()()
+	return h.nextPort()
+}
+
+// nextPort takes a freed port, or the next one after the last port given.
+// The caller holds lockWrite.
+func (h *UsersHole) nextPort() int {
+	if ports, _ := h.freePorts.GetAll(); len(ports) > 0 {
+		h.freePorts.Del(ports[0])
+		if port, err := strconv.Atoi(ports[0]); err == nil {
+			return port
+		}
+	}
 	lastport, _ := h.seq.Inc("holeserverport")
 	port, _ := strconv.Atoi(lastport)
 	if port < minPort {
@@ -403,19 +618,133 @@ func init() {
 	flag.StringVar(&holeHost, "hole_host", "127.0.0.1", "The holed host.")
 	flag.StringVar(&configPath, "config_dir", "config/", "The config path.")
 	flag.IntVar(&minPort, "min_port", 10000, "The min holed port.")
-	var sgUser = flag.String("sendgrid_user", "", "The SendGrid username.")
-	var sgKey = flag.String("sendgrid_key", "", "The SendGrid password.")
+	for _, name := range LimitNames {
+		defaultLimits[name] = -1
+		flag.Var(limitFlag(name), "max_"+name, "The default "+name+" limit per user, -1 for unlimited.")
+	}
+	flag.StringVar(&defaultPlan, "default_plan", "", "The plan of users without one, none when empty so the --max_* limits apply.")
+	flag.StringVar(&signupMode, "signup_mode", "open", "Who can sign up. open invite domain")
+	flag.StringVar(&signupDomains, "signup_domains", "", "The comma separated email domains allowed in domain signup mode.")
+	flag.BoolVar(&webhookPrivate, "webhook_private", false, "Allow webhooks to loopback and private addresses.")
+	flag.StringVar(&metricsToken, "metrics_token", "", "The bearer token scrapers read /metrics with, admins can read it without.")
+	flag.StringVar(&reportToken, "report_token", "", "The token hole servers use to report traffic and connections, reports are refused when empty.")
+	flag.IntVar(&connectionLogDays, "connection_log_days", 7, "The days to keep the connection log of holes.")
+	flag.IntVar(&certExpiryDays, "cert_expiry_days", 30, "Warn owners this many days before their certificate expires.")
+	flag.IntVar(&heartbeatGrace, "heartbeat_grace", 90, "Seconds without a client heartbeat before a hole is disconnected.")
+	flag.StringVar(&onDisconnect, "on_disconnect", DisconnectKeep, "What to do with a disconnected hole by default. keep kill")
+	flag.IntVar(&reconcileInterval, "reconcile_interval", 60, "Seconds between two reconciliations of config_dir with the store, 0 to only reconcile at start.")
+	flag.IntVar(&controllerInterval, "controller_interval", 5, "Seconds between two runs of the controller that restarts crashed holes, 0 to disable it.")
+	flag.StringVar(&storeBackend, "store", "bolt", "The storage backend. bolt sqlite postgres")
+	flag.StringVar(&storeDSN, "store_dsn", "", "The database of the store, config_dir/bolt.db or config_dir/holehub.sqlite when empty.")
+	flag.BoolVar(&runWorkers, "workers", true, "Run the background jobs, disable it on all but one of the instances sharing a SQL store.")
+	flag.StringVar(&backupDir, "backup_dir", "", "The directory of the scheduled backups, none are taken when empty.")
+	flag.IntVar(&backupInterval, "backup_interval", 24, "Hours between two scheduled backups.")
+	flag.IntVar(&backupKeep, "backup_keep", 7, "The scheduled backups to keep.")
+	flag.StringVar(&adminName, "admin", "", "The user to grant admin rights at start.")
+	flag.StringVar(&mailerConf.Backend, "mailer", "sendgrid", "The mail backend. sendgrid smtp file")
+	flag.StringVar(&mailerConf.SendGridUser, "sendgrid_user", "", "The SendGrid username.")
+	flag.StringVar(&mailerConf.SendGridKey, "sendgrid_key", "", "The SendGrid password.")
+	flag.StringVar(&mailerConf.SMTPHost, "smtp_host", "", "The SMTP server host.")
+	flag.IntVar(&mailerConf.SMTPPort, "smtp_port", 587, "The SMTP server port.")
+	flag.StringVar(&mailerConf.SMTPUser, "smtp_user", "", "The SMTP username.")
+	flag.StringVar(&mailerConf.SMTPPassword, "smtp_password", "", "The SMTP password.")
+	flag.BoolVar(&mailerConf.SMTPPlaintext, "smtp_plaintext", false, "Send to SMTP servers without STARTTLS.")
+	flag.StringVar(&mailerConf.Dir, "mail_dir", "", "The directory the file mailer writes to, log when empty.")
+	flag.StringVar(&baseURL, "base_url", "http://holehub.com", "The public base url used in mails.")
+	flag.StringVar(&defaultLocale, "default_locale", "zh_CN", "The mail locale for users without one.")
+	flag.StringVar(&mailFrom, "mail_from", "support@holehub.com", "The sender address.")
+	flag.StringVar(&mailFromName, "mail_from_name", "HoleHUB Support", "The sender name.")
+}
+
+// parseFlags parses and checks the command line.
+func parseFlags() {
 	flag.Parse()
-	sg = sendgrid.NewSendGridClient(*sgUser, *sgKey)
+	var err error
+	if mailer, err = NewMailer(mailerConf); err != nil {
+		log.Fatal(err)
+	}
+	switch signupMode {
+	case "open", "invite", "domain":
+	default:
+		log.Fatalf("Unknown signup_mode: %s", signupMode)
+	}
+	if !validPolicy(onDisconnect, heartbeatGrace) {
+		log.Fatalf("Unknown on_disconnect or heartbeat_grace: %s %d", onDisconnect, heartbeatGrace)
+	}
+	if backupDir != "" && (backupInterval < 1 || backupKeep < 1) {
+		log.Fatalf("backup_interval and backup_keep must be at least 1: %d %d", backupInterval, backupKeep)
+	}
+}
+
+// openStore opens the store of the backend and sets up the stores used by
+// the handlers and the maintenance commands.
+func openStore() Permissions {
+	perm, err := OpenBackend(storeBackend, storeDSN)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	userstate = perm.UserState()
+	storeLocks = NewStoreLocker(userstate.Host())
+
+	creator := userstate.Creator()
+	emails, _ = creator.NewKeyValue("emails")
+	passwordTokens, _ = creator.NewKeyValue("password_tokens")
+	usershole = NewUsersHole(userstate)
+	auditLog, _ = creator.NewList("audit")
+	exports, _ = creator.NewKeyValue("exports")
+	outbox, _ = creator.NewHashMap("outbox")
+	outboxPending, _ = creator.NewSet("outbox_pending")
+	usage, _ = creator.NewKeyValue("usage")
+	usageRecords, _ = creator.NewHashMap("usage_records")
+	invitations, _ = creator.NewHashMap("invitations")
+	holeStats, _ = creator.NewHashMap("hole_stats")
+	connectionLog, _ = creator.NewHashMap("connection_log")
+	connectionIndex, _ = creator.NewHashMap("connection_index")
+	webhooks, _ = creator.NewHashMap("webhooks")
+	webhookDeliveries, _ = creator.NewHashMap("webhook_deliveries")
+	webhookPending, _ = creator.NewSet("webhook_pending")
+	meta, _ = creator.NewKeyValue("meta")
+	if err := LoadPlans(); err != nil {
+		log.Fatal(err)
+	}
+	return perm
+}
+
+// FeatureRoutes adds the routes of the features kept in their own files.
+// mux matches routes in the order they were added, so the by-name routes of
+// HoleRoutes go before the {holeID}/stats and {holeID}/connections routes.
+func FeatureRoutes(router *mux.Router, r *render.Render) {
+	AdminRoutes(router, r)
+	OrgRoutes(router, r)
+	InvitationRoutes(router, r)
+	HoleRoutes(router, r)
+	TrafficRoutes(router, r)
+	ConnectionLogRoutes(router, r)
+	EventRoutes(router, r)
+	WebhookRoutes(router, r)
+	HeartbeatRoutes(router, r)
 }
 
 func main() {
+	parseFlags()
+	if flag.NArg() > 0 {
+		openStore()
+		if err := RunCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	router := mux.NewRouter()
 
 	r := render.New()
 
 	// New permissions middleware
-	perm, _ := permissions.NewWithConf(configPath + "bolt.db")
+	perm := openStore()
+	if err := Migrate(); err != nil {
+		log.Fatal(err)
+	}
 
 	perm.AddUserPath("/api/holes/")
 	perm.AddUserPath("/api/new_ca/")
@@ -424,14 +753,41 @@ func main() {
 	perm.AddUserPath("/api/ca.key")
 	perm.AddUserPath("/api/cert.pem")
 	perm.AddUserPath("/api/cert.key")
+	perm.AddUserPath("/api/account")
+	perm.AddUserPath("/api/orgs/")
+	perm.AddUserPath("/api/invitations/")
+	perm.AddUserPath("/api/audit/")
+	perm.AddUserPath("/api/events")
+	perm.AddUserPath("/api/webhooks/")
+	perm.AddAdminPath("/api/admin/")
+
+	if runWorkers {
+		go RunWebhooks()
+		go RunOutbox()
+		go RunUsageRecorder()
+		go RunStatsPruner()
+		go RunConnectionLogPruner()
+		go RunCertExpiryCheck()
+		go RunHeartbeatWatch()
+		go ResumeExports()
+
+		Reconcile()
+		if reconcileInterval > 0 {
+			go RunReconciler()
+		}
+		if controllerInterval > 0 {
+			go RunController()
+		}
+		if backupDir != "" {
+			go RunBackups()
+		}
+	}
 
-	// Get the userstate, used in the handlers below
-	userstate := perm.UserState()
+	if adminName != "" && userstate.HasUser(adminName) {
+		userstate.SetAdminStatus(adminName)
+	}
 
-	creator := userstate.Creator()
-	emails, _ := creator.NewKeyValue("emails")
-	passwordTokens, _ := creator.NewKeyValue("password_tokens")
-	usershole := NewUsersHole(userstate)
+	router.HandleFunc("/metrics", MetricsHandler).Methods("GET")
 
 	router.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "Hello HoleHub.")
@@ -443,6 +799,10 @@ func main() {
 		if errs.Handle(w) {
 			return
 		}
+		if !ValidUsername(userForm.Name) {
+			r.JSON(w, http.StatusOK, ErrorMessages[38])
+			return
+		}
 		if userstate.HasUser(userForm.Name) {
 			r.JSON(w, http.StatusOK, ErrorMessages[1])
 			return
@@ -455,19 +815,20 @@ func main() {
 			r.JSON(w, http.StatusOK, ErrorMessages[3])
 			return
 		}
-		userstate.AddUser(userForm.Name, userForm.Password, userForm.Email)
-		emails.Set(userForm.Email, userForm.Name)
-		GenerateUserCa(userForm.Name)
-		GenerateUserCert(userForm.Name)
-		users := userstate.Users()
-		ca := userForm.Name + "-ca.pem"
-		cakey := userForm.Name + "-ca.key"
-		cert := userForm.Name + "-cert.pem"
-		certkey := userForm.Name + "-cert.key"
-		users.Set(userForm.Name, "ca", ca)
-		users.Set(userForm.Name, "cakey", cakey)
-		users.Set(userForm.Name, "cert", cert)
-		users.Set(userForm.Name, "certkey", certkey)
+		invitation, errMsg := CheckSignup(userForm.Email, userForm.Invitation)
+		if errMsg != nil {
+			r.JSON(w, http.StatusOK, errMsg)
+			return
+		}
+		CreateAccount(userForm.Name, userForm.Password, userForm.Email)
+		if invitation != nil {
+			invitation.Join(userForm.Name)
+		}
+		Audit(userForm.Name, "auth.signup", userForm.Name, req)
+		Audit(userForm.Name, "cert.issue", userForm.Name, req)
+		if reLocale.MatchString(userForm.Locale) {
+			userstate.Users().Set(userForm.Name, "locale", userForm.Locale)
+		}
 
 		code, _ := userstate.GenerateUniqueConfirmationCode()
 		userstate.AddUnconfirmed(userForm.Name, code)
@@ -487,10 +848,20 @@ func main() {
 			name, _ = emails.Get(authForm.NameOrEmail)
 		}
 		if !userstate.CorrectPassword(name, authForm.Password) {
+			Audit(authForm.NameOrEmail, "auth.signin.failed", name, req)
+			signins.Inc("failure")
 			r.JSON(w, http.StatusOK, ErrorMessages[4])
 			return
 		}
+		if IsSuspended(name) {
+			Audit(name, "auth.signin.suspended", name, req)
+			signins.Inc("failure")
+			r.JSON(w, http.StatusOK, ErrorMessages[16])
+			return
+		}
 		userstate.Login(w, name)
+		Audit(name, "auth.signin", name, req)
+		signins.Inc("success")
 		r.JSON(w, http.StatusOK, ErrorMessages[0])
 	}).Methods("POST")
 
@@ -507,8 +878,22 @@ func main() {
 		req.ParseForm()
 		scheme := req.Form.Get("scheme")
 		holeName := req.Form.Get("name")
+		labels, ok := parseLabels(req.Form.Get("labels"))
+		if !ok {
+			r.JSON(w, http.StatusOK, ErrorMessages[34])
+			return
+		}
 
-		hs := usershole.NewHoleApp(username, holeName, scheme)
+		hs, name, err := NewHoleAppInQuota(username, holeName, scheme, labels)
+		if name != "" {
+			r.JSON(w, http.StatusOK, quotaError(name))
+			return
+		}
+		if err != nil {
+			holeCreateError(w, r, err)
+			return
+		}
+		Audit(username, "hole.create", hs.ID, req)
 		r.JSON(w, http.StatusOK, map[string]HoleApp{"hole": *hs})
 	}).Methods("POST")
 
@@ -520,7 +905,16 @@ func main() {
 			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
 			return
 		}
-		hs.Start()
+		name, err := StartInQuota(username, hs)
+		if name != "" {
+			r.JSON(w, http.StatusOK, quotaError(name))
+			return
+		}
+		if err != nil {
+			holeStartError(w, r, holeID, err)
+			return
+		}
+		Audit(username, "hole.start", holeID, req)
 		r.JSON(w, http.StatusOK, ErrorMessages[0])
 	}).Methods("POST")
 
@@ -529,9 +923,11 @@ func main() {
 		username := userstate.Username(req)
 		hs := usershole.GetOne(username, holeID)
 		if hs == nil {
-			hs = &HoleApp{ID: holeID}
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
 		}
 		hs.Kill()
+		Audit(username, "hole.kill", holeID, req)
 		r.JSON(w, http.StatusOK, ErrorMessages[0])
 	}).Methods("POST")
 
@@ -542,6 +938,7 @@ func main() {
 			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
 			return
 		}
+		Audit(username, "hole.remove", holeID, req)
 		r.JSON(w, http.StatusOK, ErrorMessages[0])
 	}).Methods("POST")
 
@@ -565,6 +962,7 @@ func main() {
 	router.HandleFunc("/api/new_ca/", func(w http.ResponseWriter, req *http.Request) {
 		username := userstate.Username(req)
 		GenerateUserCa(username)
+		Audit(username, "cert.ca.issue", username, req)
 		r.JSON(w, http.StatusOK, ErrorMessages[0])
 	}).Methods("POST")
 
@@ -583,6 +981,7 @@ func main() {
 	router.HandleFunc("/api/new_cert/", func(w http.ResponseWriter, req *http.Request) {
 		username := userstate.Username(req)
 		GenerateUserCert(username)
+		Audit(username, "cert.issue", username, req)
 		r.JSON(w, http.StatusOK, ErrorMessages[0])
 	}).Methods("POST")
 
@@ -600,10 +999,12 @@ func main() {
 
 	router.HandleFunc("/api/confirm/{confirmationCode}", func(w http.ResponseWriter, req *http.Request) {
 		code := mux.Vars(req)["confirmationCode"]
+		username, _ := userstate.FindUserByConfirmationCode(code)
 		if err := userstate.ConfirmUserByConfirmationCode(code); err != nil {
 			r.JSON(w, http.StatusOK, ErrorMessages[5])
 			return
 		}
+		Audit(username, "auth.confirm", username, req)
 		msg := ErrorMessages[0]
 		r.JSON(w, http.StatusOK, msg)
 	}).Methods("GET")
@@ -669,6 +1070,7 @@ func main() {
 		users := userstate.Users()
 		passwordHash := userstate.HashPassword(username, resetPasswordForm.NewPassword)
 		users.Set(username, "password", passwordHash)
+		Audit(username, "auth.password.reset", username, req)
 		r.JSON(w, http.StatusOK, ErrorMessages[0])
 	}).Methods("POST")
 
@@ -683,30 +1085,111 @@ func main() {
 			return
 		}
 
-		loop := 0
-		var code string
-		for {
-			code, _ := userstate.GenerateUniqueConfirmationCode()
-			tokenStr, _ := passwordTokens.Get(code)
-			if tokenStr == "" {
-				break
-			}
-			loop = loop + 1
-			if loop > 1000 {
-				http.Error(w, "Too many loops...", http.StatusInternalServerError)
-				return
-			}
+		code, err := NewPasswordToken(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		email, _ := userstate.Email(username)
-		expiredAt := time.Now().Add(12 * time.Hour).Unix()
-		passwordTokens.Set(code, fmt.Sprintf("{\"username\": \"%s\", \"expiredAt\": \"%d\"}", username, expiredAt))
-
 		SendPasswordToken(username, email, code)
+		Audit(username, "auth.password.token", username, req)
 		msg := ErrorMessages[0]
 		r.JSON(w, http.StatusOK, msg)
 	}).Methods("POST")
 
+	router.HandleFunc("/api/account", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		if !userstate.CorrectPassword(username, requestPassword(req)) {
+			r.JSON(w, http.StatusForbidden, ErrorMessages[11])
+			return
+		}
+		DeleteAccount(username)
+		userstate.ClearCookie(w)
+		Audit(username, "account.delete", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("DELETE")
+
+	router.HandleFunc("/api/account/usage", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		r.JSON(w, http.StatusOK, map[string]map[string]int64{
+			"usage":  UserUsage(username),
+			"limits": EffectiveLimits(username),
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/account/billing", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		period := billingPeriod(req)
+		records, err := UsageRecords(username, period)
+		if err != nil {
+			r.JSON(w, http.StatusOK, ErrorMessages[18])
+			return
+		}
+		if req.Form.Get("format") == "csv" {
+			writeUsageCSV(w, period, records)
+			return
+		}
+		r.JSON(w, http.StatusOK, map[string]interface{}{
+			"plan":    UserPlan(username),
+			"period":  period,
+			"records": records,
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/plans/", func(w http.ResponseWriter, req *http.Request) {
+		list := make([]Plan, 0, len(plans))
+		for _, name := range PlanNames() {
+			list = append(list, plans[name])
+		}
+		r.JSON(w, http.StatusOK, map[string][]Plan{"plans": list})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/audit/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		writeAudit(w, req, AuditEntries(auditFilter(req, username)))
+	}).Methods("GET")
+
+	router.HandleFunc("/api/account/locale/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		req.ParseForm()
+		locale := req.Form.Get("locale")
+		if !reLocale.MatchString(locale) {
+			r.JSON(w, http.StatusOK, ErrorMessages[13])
+			return
+		}
+		userstate.Users().Set(username, "locale", locale)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/account/export/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		if _, err := StartExport(username); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Audit(username, "account.export", username, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/export/{token}", func(w http.ResponseWriter, req *http.Request) {
+		token := mux.Vars(req)["token"]
+		job, ok := GetExportJob(token)
+		if !ok || job.Status != "ready" {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[12])
+			return
+		}
+		if job.ExpiredAt < time.Now().Unix() {
+			RemoveExport(token)
+			r.JSON(w, http.StatusNotFound, ErrorMessages[12])
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename="+exportFileName(job))
+		http.ServeFile(w, req, exportFile(token))
+	}).Methods("GET")
+
+	FeatureRoutes(router, r)
+
 	// Custom handler for when permissions are denied
 	perm.SetDenyFunction(func(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Permission denied!", http.StatusForbidden)
@@ -714,7 +1197,9 @@ func main() {
 
 	n := negroni.Classic()
 
+	n.Use(MetricsMiddleware(router))
 	n.Use(perm)
+	n.Use(negroni.HandlerFunc(suspendedCheck))
 	n.Use(cors.NewAllow(&cors.Options{AllowAllOrigins: true}))
 	n.UseHandler(router)
 
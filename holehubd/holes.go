@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A hole is kept as the fields of a HoleRecord in the holes hash map. The
+// hole_index hash map indexes the holes by owner, in the holes field of the
+// owner, and by owner and name, in the name:<name> field of the owner, each
+// as a JSON list of hole ids.
+var errHoleNameExists = fmt.Errorf("Hole name exists")
+var errHoleRemoved = fmt.Errorf("Hole is removed")
+
+// lockHole takes the store lock of a hole. Start, kill, remove and the
+// controller hold it, so they act on a hole one at a time and not on a
+// removed one.
+func lockHole(holeID string) func() {
+	return lockStore("hole:" + holeID)
+}
+
+// holeExists tells if the hole is still in the store. The caller holds
+// lockHole.
+func holeExists(holeID string) bool {
+	ok, _ := usershole.holes.Exists(holeID)
+	return ok
+}
+
+type HoleRecord struct {
+	ID        string
+	Owner     string
+	Name      string
+	Scheme    string
+	Port      string
+	Ca        string
+	Cakey     string
+	CreatedAt int64
+	UpdatedAt int64
+	Labels    map[string]string
+}
+
+var reLabelKey = regexp.MustCompile("^[a-zA-Z0-9][-_.a-zA-Z0-9]{0,62}$")
+
+func decodeLabels(data string) map[string]string {
+	labels := make(map[string]string)
+	json.Unmarshal([]byte(data), &labels)
+	return labels
+}
+
+// parseLabels reads labels given as key=value,key=value.
+func parseLabels(s string) (map[string]string, bool) {
+	labels := make(map[string]string)
+	for _, pair := range splitList(s) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !reLabelKey.MatchString(kv[0]) {
+			return nil, false
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, true
+}
+
+// GetRecord returns the record of the hole, or nil if it does not exist.
+func (h *UsersHole) GetRecord(holeID string) *HoleRecord {
+	if ok, _ := h.holes.Exists(holeID); !ok || holeID == "" {
+		return nil
+	}
+	rec := &HoleRecord{ID: holeID}
+	rec.Owner, _ = h.holes.Get(holeID, "owner")
+	rec.Name, _ = h.holes.Get(holeID, "name")
+	rec.Scheme, _ = h.holes.Get(holeID, "scheme")
+	rec.Port, _ = h.holes.Get(holeID, "port")
+	rec.Ca, _ = h.holes.Get(holeID, "ca")
+	rec.Cakey, _ = h.holes.Get(holeID, "cakey")
+	rec.CreatedAt = getHoleInt(holeID, "created_at")
+	rec.UpdatedAt = getHoleInt(holeID, "updated_at")
+	labels, _ := h.holes.Get(holeID, "labels")
+	rec.Labels = decodeLabels(labels)
+	return rec
+}
+
+// saveRecord writes the record and stamps it.
+func (h *UsersHole) saveRecord(rec *HoleRecord) {
+	rec.UpdatedAt = time.Now().Unix()
+	if rec.CreatedAt == 0 {
+		rec.CreatedAt = rec.UpdatedAt
+	}
+	if rec.Labels == nil {
+		rec.Labels = make(map[string]string)
+	}
+	labels, _ := json.Marshal(rec.Labels)
+	h.holes.Set(rec.ID, "owner", rec.Owner)
+	h.holes.Set(rec.ID, "name", rec.Name)
+	h.holes.Set(rec.ID, "scheme", rec.Scheme)
+	h.holes.Set(rec.ID, "port", rec.Port)
+	h.holes.Set(rec.ID, "ca", rec.Ca)
+	h.holes.Set(rec.ID, "cakey", rec.Cakey)
+	h.holes.Set(rec.ID, "labels", string(labels))
+	h.holes.Set(rec.ID, "created_at", strconv.FormatInt(rec.CreatedAt, 10))
+	h.holes.Set(rec.ID, "updated_at", strconv.FormatInt(rec.UpdatedAt, 10))
+}
+
+// touchHole stamps the hole as updated now.
+func touchHole(holeID string) {
+	setHoleInt(holeID, "updated_at", time.Now().Unix())
+}
+
+// indexList reads an index field of owner. The caller holds lock.
+func (h *UsersHole) indexList(owner, field string) []string {
+	ids := make([]string, 0)
+	data, _ := h.index.Get(owner, field)
+	if data != "" {
+		json.Unmarshal([]byte(data), &ids)
+	}
+	return ids
+}
+
+// setIndexList writes an index field of owner, dropping it when empty. The
+// caller holds lockWrite.
+func (h *UsersHole) setIndexList(owner, field string, ids []string) {
+	if len(ids) == 0 {
+		h.index.DelKey(owner, field)
+		return
+	}
+	data, _ := json.Marshal(ids)
+	h.index.Set(owner, field, string(data))
+}
+
+func indexOf(ids []string, id string) int {
+	for i, other := range ids {
+		if other == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexAdd adds the hole to the owner and name indexes of owner. The caller
+// holds lockWrite.
+func (h *UsersHole) indexAdd(owner, name, holeID string) {
+	for _, field := range []string{"holes", "name:" + name} {
+		ids := h.indexList(owner, field)
+		if indexOf(ids, holeID) < 0 {
+			h.setIndexList(owner, field, append(ids, holeID))
+		}
+	}
+}
+
+// indexRemove removes the hole from the owner and name indexes of owner.
+// The caller holds lockWrite.
+func (h *UsersHole) indexRemove(owner, name, holeID string) {
+	for _, field := range []string{"holes", "name:" + name} {
+		ids := h.indexList(owner, field)
+		if i := indexOf(ids, holeID); i >= 0 {
+			h.setIndexList(owner, field, append(ids[:i], ids[i+1:]...))
+		}
+	}
+}
+
+// owns tells if holeID is one of the holes of owner. The caller holds lock.
+func (h *UsersHole) owns(owner, holeID string) bool {
+	return holeID != "" && indexOf(h.indexList(owner, "holes"), holeID) >= 0
+}
+
+// HoleIDs returns the holes of owner, oldest first.
+func (h *UsersHole) HoleIDs(owner string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.indexList(owner, "holes")
+}
+
+// HoleIDsByName returns the holes of owner called name.
+func (h *UsersHole) HoleIDsByName(owner, name string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.indexList(owner, "name:"+name)
+}
+
+// SetLabels replaces the labels of a hole of owner.
+func (h *UsersHole) SetLabels(owner, holeID string, labels map[string]string) bool {
+	defer h.lockWrite()()
+	if !h.owns(owner, holeID) {
+		return false
+	}
+	rec := h.GetRecord(holeID)
+	if rec == nil {
+		return false
+	}
+	rec.Labels = labels
+	h.saveRecord(rec)
+	return true
+}
+
+// holeCreateError renders why a hole could not be created.
+func holeCreateError(w http.ResponseWriter, r *render.Render, err error) {
+	if err == errHoleNameExists {
+		r.JSON(w, http.StatusConflict, ErrorMessages[36])
+		return
+	}
+	r.JSON(w, http.StatusNotFound, ErrorMessages[7])
+}
+
+// holeStartError answers a failed start with the error and the state the
+// controller recorded. The hole stays desired running, so the controller
+// retries it with backoff.
+func holeStartError(w http.ResponseWriter, r *render.Render, holeID string, err error) {
+	if err == errHoleRemoved {
+		r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+		return
+	}
+	msg := errorMessage(41, err.Error())
+	msg["observed_state"], _ = usershole.holes.Get(holeID, "observed_state")
+	msg["last_error"], _ = usershole.holes.Get(holeID, "last_error")
+	r.JSON(w, http.StatusInternalServerError, msg)
+}
+
+// byNameHandler returns the hole called name of the owner given by
+// getOwner. Holes created before names were unique may share a name, those
+// are only reachable by ID.
+func byNameHandler(r *render.Render, getOwner func(req *http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		owner := getOwner(req)
+		ids := usershole.HoleIDsByName(owner, mux.Vars(req)["name"])
+		if owner == "" || len(ids) == 0 {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		if len(ids) > 1 {
+			r.JSON(w, http.StatusConflict, ErrorMessages[37])
+			return
+		}
+		hs := usershole.GetOne(owner, ids[0])
+		if hs == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		r.JSON(w, http.StatusOK, hs)
+	}
+}
+
+// labelsHandler sets the labels of the hole of the owner given by getOwner.
+func labelsHandler(r *render.Render, getOwner func(req *http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		owner := getOwner(req)
+		holeID := mux.Vars(req)["holeID"]
+		req.ParseForm()
+		labels, ok := parseLabels(req.Form.Get("labels"))
+		if !ok {
+			r.JSON(w, http.StatusOK, ErrorMessages[34])
+			return
+		}
+		if owner == "" || !usershole.SetLabels(owner, holeID, labels) {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		Audit(userstate.Username(req), "hole.labels", holeID, req)
+		r.JSON(w, http.StatusOK, usershole.GetOne(owner, holeID))
+	}
+}
+
+func HoleRoutes(router *mux.Router, r *render.Render) {
+	router.HandleFunc("/api/holes/by-name/{name}", byNameHandler(r, func(req *http.Request) string {
+		return userstate.Username(req)
+	})).Methods("GET")
+
+	router.HandleFunc("/api/orgs/{org}/holes/by-name/{name}", byNameHandler(r, func(req *http.Request) string {
+		org := mux.Vars(req)["org"]
+		if !HasOrgRole(org, userstate.Username(req), "viewer") {
+			return ""
+		}
+		return OrgOwner(org)
+	})).Methods("GET")
+
+	router.HandleFunc("/api/holes/{holeID}/labels/", labelsHandler(r, func(req *http.Request) string {
+		return userstate.Username(req)
+	})).Methods("POST")
+
+	router.HandleFunc("/api/orgs/{org}/holes/{holeID}/labels/", labelsHandler(r, func(req *http.Request) string {
+		org := mux.Vars(req)["org"]
+		if !HasOrgRole(org, userstate.Username(req), "member") {
+			return ""
+		}
+		return OrgOwner(org)
+	})).Methods("POST")
+}
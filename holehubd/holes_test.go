@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// openTestStore opens a SQLite store in a temporary config_dir holding a
+// launch file template and a certs directory, with user alice.
+func openTestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "holehubd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath = dir + "/"
+	os.Mkdir(configPath+"certs", 0700)
+	tpl := `{"addr": "{{.Scheme}}://{{.Host}}:{{.Port}}"}`
+	if err := ioutil.WriteFile(configPath+tplFile, []byte(tpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storeBackend = "sqlite"
+	storeDSN = filepath.Join(dir, "holehub.sqlite")
+	openStore()
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	userstate.AddUser("alice", "secret", "alice@example.com")
+	state := userstate
+	t.Cleanup(func() {
+		state.Host().Close()
+		os.RemoveAll(dir)
+	})
+}
+
+func TestNewHoleAppRace(t *testing.T) {
+	openTestStore(t)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	created := 0
+	ports := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+			if err == nil {
+				lock.Lock()
+				created++
+				lock.Unlock()
+			} else if err != errHoleNameExists {
+				t.Error(err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			hs, err := usershole.NewHoleApp("alice", "hole"+strconv.Itoa(i), "tcp", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lock.Lock()
+			if ports[hs.Port] {
+				t.Error("port given twice", hs.Port)
+			}
+			ports[hs.Port] = true
+			lock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Fatalf("%d holes named web created, want 1", created)
+	}
+	if n := len(usershole.HoleIDs("alice")); n != 21 {
+		t.Fatalf("%d holes indexed, want 21", n)
+	}
+}
+
+func TestHoleLifecycleRace(t *testing.T) {
+	openTestStore(t)
+
+	holes := make([]*HoleApp, 10)
+	for i := range holes {
+		hs, err := usershole.NewHoleApp("alice", "hole"+strconv.Itoa(i), "tcp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		holes[i] = hs
+	}
+
+	var wg sync.WaitGroup
+	for _, hs := range holes {
+		for i := 0; i < 5; i++ {
+			wg.Add(4)
+			go func(hs HoleApp) {
+				defer wg.Done()
+				hs.Start()
+			}(*hs)
+			go func(hs HoleApp) {
+				defer wg.Done()
+				hs.Kill()
+			}(*hs)
+			go func(hs HoleApp) {
+				defer wg.Done()
+				DriveHole("alice", &hs)
+			}(*hs)
+			go func(holeID string) {
+				defer wg.Done()
+				usershole.Remove("alice", holeID)
+			}(hs.ID)
+		}
+	}
+	wg.Wait()
+
+	for _, hs := range holes {
+		if hs.Alive() {
+			t.Error("removed hole", hs.ID, "still has a launch file")
+		}
+		if holeExists(hs.ID) {
+			t.Error("removed hole", hs.ID, "still has a record")
+		}
+		if err := hs.Start(); err != errHoleRemoved {
+			t.Error("start of removed hole", hs.ID, "returned", err)
+		}
+	}
+	if n := len(usershole.HoleIDs("alice")); n != 0 {
+		t.Fatalf("%d holes indexed, want 0", n)
+	}
+	ports, _ := usershole.freePorts.GetAll()
+	if len(ports) != len(holes) {
+		t.Fatalf("%d ports freed, want %d", len(ports), len(holes))
+	}
+}
+
+func TestByNameRoutes(t *testing.T) {
+	router := mux.NewRouter()
+	FeatureRoutes(router, render.New())
+	for _, path := range []string{
+		"/api/holes/by-name/stats",
+		"/api/holes/by-name/connections",
+		"/api/orgs/acme/holes/by-name/stats",
+		"/api/orgs/acme/holes/by-name/connections",
+	} {
+		var match mux.RouteMatch
+		if !router.Match(httptest.NewRequest("GET", path, nil), &match) {
+			t.Error(path, "has no route")
+			continue
+		}
+		if match.Vars["name"] == "" {
+			t.Error(path, "is not routed by name")
+		}
+	}
+}
+
+func TestHoleStartError(t *testing.T) {
+	openTestStore(t)
+	hs, err := usershole.NewHoleApp("alice", "web", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := configPath
+	configPath = dir + "missing/"
+	_, err = StartInQuota("alice", hs)
+	configPath = dir
+	if err == nil {
+		t.Fatal("start without a config_dir succeeded")
+	}
+	w := httptest.NewRecorder()
+	holeStartError(w, render.New(), hs.ID, err)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatal("failed start answered", w.Code)
+	}
+	var msg map[string]string
+	json.Unmarshal(w.Body.Bytes(), &msg)
+	if msg["code"] != "41" || msg["observed_state"] != ObservedCrashed || msg["last_error"] == "" {
+		t.Fatal("failed start answered", msg)
+	}
+	if state, _ := usershole.holes.Get(hs.ID, "desired_state"); state != DesiredRunning {
+		t.Fatal("desired state is", state)
+	}
+
+	usershole.Remove("alice", hs.ID)
+	w = httptest.NewRecorder()
+	holeStartError(w, render.New(), hs.ID, hs.Start())
+	if w.Code != http.StatusNotFound {
+		t.Fatal("start of a removed hole answered", w.Code)
+	}
+}
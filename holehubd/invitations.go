@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"github.com/xyproto/pinterface"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signupMode is open, invite (an invitation is required) or domain (the
+// email has to be in signupDomains unless an invitation is given).
+var signupMode string
+var signupDomains string
+
+var invitations pinterface.IHashMap
+
+type Invitation struct {
+	Code      string `json:"code"`
+	Email     string `json:"email"`
+	Org       string `json:"org"`
+	Role      string `json:"role"`
+	CreatedBy string `json:"createdBy"`
+	ExpiredAt int64  `json:"expiredAt"`
+	UsesLeft  int    `json:"usesLeft"`
+}
+
+func GetInvitation(code string) *Invitation {
+	if ok, _ := invitations.Exists(code); !ok || code == "" {
+		return nil
+	}
+	inv := &Invitation{Code: code}
+	inv.Email, _ = invitations.Get(code, "email")
+	inv.Org, _ = invitations.Get(code, "org")
+	inv.Role, _ = invitations.Get(code, "role")
+	inv.CreatedBy, _ = invitations.Get(code, "created_by")
+	expiredAt, _ := invitations.Get(code, "expired_at")
+	inv.ExpiredAt, _ = strconv.ParseInt(expiredAt, 10, 64)
+	usesLeft, _ := invitations.Get(code, "uses_left")
+	inv.UsesLeft, _ = strconv.Atoi(usesLeft)
+	return inv
+}
+
+// CreateInvitation stores a new invitation. When org is set the new user
+// joins it with role.
+func CreateInvitation(createdBy, email, org, role string, ttl time.Duration, uses int) (*Invitation, error) {
+	code, err := userstate.GenerateUniqueConfirmationCode()
+	if err != nil {
+		return nil, err
+	}
+	inv := &Invitation{
+		Code:      code,
+		Email:     email,
+		Org:       org,
+		Role:      role,
+		CreatedBy: createdBy,
+		ExpiredAt: time.Now().Add(ttl).Unix(),
+		UsesLeft:  uses,
+	}
+	invitations.Set(code, "email", inv.Email)
+	invitations.Set(code, "org", inv.Org)
+	invitations.Set(code, "role", inv.Role)
+	invitations.Set(code, "created_by", inv.CreatedBy)
+	invitations.Set(code, "expired_at", strconv.FormatInt(inv.ExpiredAt, 10))
+	invitations.Set(code, "uses_left", strconv.Itoa(inv.UsesLeft))
+	return inv, nil
+}
+
+// Invitations returns the invitations created by username, or all of them
+// when username is empty.
+func Invitations(username string) []*Invitation {
+	codes, _ := invitations.GetAll()
+	list := make([]*Invitation, 0)
+	for _, code := range codes {
+		inv := GetInvitation(code)
+		if inv == nil || (username != "" && inv.CreatedBy != username) {
+			continue
+		}
+		list = append(list, inv)
+	}
+	return list
+}
+
+// Valid tells if inv can be used to sign up with email.
+func (inv *Invitation) Valid(email string) bool {
+	if inv.ExpiredAt < time.Now().Unix() || inv.UsesLeft < 1 {
+		return false
+	}
+	return inv.Email == "" || strings.EqualFold(inv.Email, email)
+}
+
+// reserveInvitation takes a use of the invitation code for a signup with
+// email, or returns nil when it can not be used. The store lock makes the
+// uses hold with concurrent signups, the last one removes it.
+func reserveInvitation(code, email string) *Invitation {
+	if code == "" {
+		return nil
+	}
+	defer lockStore("invitation:" + code)()
+	inv := GetInvitation(code)
+	if inv == nil || !inv.Valid(email) {
+		return nil
+	}
+	inv.UsesLeft--
+	if inv.UsesLeft < 1 {
+		invitations.Del(inv.Code)
+	} else {
+		invitations.Set(inv.Code, "uses_left", strconv.Itoa(inv.UsesLeft))
+	}
+	return inv
+}
+
+// Join adds the new user username to the organization of the invitation.
+func (inv *Invitation) Join(username string) {
+	if inv.Org != "" && OrgExists(inv.Org) {
+		SetOrgMember(inv.Org, username, inv.Role)
+	}
+}
+
+func emailDomainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range strings.Split(signupDomains, ",") {
+		if strings.TrimSpace(strings.ToLower(allowed)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSignup returns the invitation to use for a signup with email and
+// code, and the error message when the signup mode refuses it. A returned
+// invitation is already used up by one, the signup has to go on.
+func CheckSignup(email, code string) (*Invitation, map[string]string) {
+	switch signupMode {
+	case "invite":
+		if code == "" {
+			return nil, ErrorMessages[25]
+		}
+	case "domain":
+		if code == "" && !emailDomainAllowed(email) {
+			return nil, ErrorMessages[26]
+		}
+	}
+	if code == "" {
+		return nil, nil
+	}
+	inv := reserveInvitation(code, email)
+	if inv == nil {
+		return nil, ErrorMessages[25]
+	}
+	return inv, nil
+}
+
+func InvitationRoutes(router *mux.Router, r *render.Render) {
+	router.HandleFunc("/api/invitations/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		r.JSON(w, http.StatusOK, map[string][]*Invitation{"invitations": Invitations(username)})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/invitations/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		req.ParseForm()
+		email := req.Form.Get("email")
+		org := req.Form.Get("org")
+		role := req.Form.Get("role")
+		if email != "" && !isEmail(email) {
+			r.JSON(w, http.StatusOK, ErrorMessages[3])
+			return
+		}
+		if org == "" {
+			if !userstate.IsAdmin(username) {
+				r.JSON(w, http.StatusForbidden, ErrorMessages[22])
+				return
+			}
+			role = ""
+		} else {
+			if !OrgExists(org) {
+				r.JSON(w, http.StatusNotFound, ErrorMessages[21])
+				return
+			}
+			if !userstate.IsAdmin(username) && !HasOrgRole(org, username, "owner") {
+				r.JSON(w, http.StatusForbidden, ErrorMessages[22])
+				return
+			}
+			if role == "" {
+				role = "member"
+			}
+			if _, ok := roleLevels[role]; !ok {
+				r.JSON(w, http.StatusOK, ErrorMessages[24])
+				return
+			}
+		}
+		hours, err := strconv.Atoi(req.Form.Get("expires_in"))
+		if err != nil || hours < 1 {
+			hours = 7 * 24
+		}
+		uses, err := strconv.Atoi(req.Form.Get("uses"))
+		if err != nil || uses < 1 {
+			uses = 1
+		}
+		inv, err := CreateInvitation(username, email, org, role, time.Duration(hours)*time.Hour, uses)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if email != "" {
+			SendInvitation(username, email, inv)
+		}
+		Audit(username, "invitation.create", inv.Code, req)
+		r.JSON(w, http.StatusOK, map[string]*Invitation{"invitation": inv})
+	}).Methods("POST")
+
+	router.HandleFunc("/api/invitations/{code}", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		inv := GetInvitation(mux.Vars(req)["code"])
+		if inv == nil || (inv.CreatedBy != username && !userstate.IsAdmin(username)) {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[25])
+			return
+		}
+		invitations.Del(inv.Code)
+		Audit(username, "invitation.delete", inv.Code, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("DELETE")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/xyproto/pinterface"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LimitNames are the per-user limits an admin can set. They are stored on
+// the user record as limit_<name>; a missing value falls back to the
+// default and a negative one means unlimited. transfer is in bytes per
+// month and connections counts concurrent public connections.
+var LimitNames = []string{"holes", "running_holes", "ports", "transfer", "connections"}
+
+func isLimitName(name string) bool {
+	for _, n := range LimitNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// UserLimits returns the limits set on username.
+func UserLimits(username string) map[string]int64 {
+	users := userstate.Users()
+	limits := make(map[string]int64)
+	for _, name := range LimitNames {
+		value, _ := users.Get(username, "limit_"+name)
+		if value == "" {
+			continue
+		}
+		if limit, err := strconv.ParseInt(value, 10, 64); err == nil {
+			limits[name] = limit
+		}
+	}
+	return limits
+}
+
+// SetUserLimit sets one limit on username. An empty value removes it.
+func SetUserLimit(username, name, value string) error {
+	users := userstate.Users()
+	if value == "" {
+		return users.DelKey(username, "limit_"+name)
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		return err
+	}
+	return users.Set(username, "limit_"+name, value)
+}
+
+// defaultLimits apply to users without their own limit. They are set with
+// the --max_* flags.
+var defaultLimits = make(map[string]int64)
+
+var usage pinterface.IKeyValue
+
+var connections = struct {
+	sync.Mutex
+	count map[string]int64
+}{count: make(map[string]int64)}
+
+// EffectiveLimits returns the limits that apply to username: its own ones
+// on top of its plan on top of the defaults. Unlimited entries are left
+// out.
+func EffectiveLimits(username string) map[string]int64 {
+	limits := make(map[string]int64)
+	for name, limit := range defaultLimits {
+		limits[name] = limit
+	}
+	for name, limit := range UserPlan(username).Limits {
+		limits[name] = limit
+	}
+	for name, limit := range UserLimits(username) {
+		limits[name] = limit
+	}
+	for name, limit := range limits {
+		if limit < 0 {
+			delete(limits, name)
+		}
+	}
+	return limits
+}
+
+func transferKey(username string, t time.Time) string {
+	return username + ":" + t.Format("2006-01")
+}
+
+// AddTransfer counts bytes in and out against the monthly transfer of
+// username and its daily usage record, and returns the new monthly total.
+func AddTransfer(username string, in, out int64) int64 {
+	key := transferKey(username, time.Now())
+	unlock := lockStore("transfer:" + username)
+	value, _ := usage.Get(key)
+	total, _ := strconv.ParseInt(value, 10, 64)
+	total += in + out
+	usage.Set(key, strconv.FormatInt(total, 10))
+	unlock()
+	recordBytes(username, in, out)
+	return total
+}
+
+// SetConnections records the current number of public connections of
+// username.
+func SetConnections(username string, count int64) {
+	connections.Lock()
+	connections.count[username] = count
+	connections.Unlock()
+	recordConnections(username, count)
+}
+
+// accountOf returns the user whose limits and usage the holes of owner
+// count against. Organizations count against their OrgAccount.
+func accountOf(owner string) string {
+	if name, isOrg := orgName(owner); isOrg {
+		return OrgAccount(name)
+	}
+	return owner
+}
+
+// accountOwners returns username and the organizations that count against
+// it.
+func accountOwners(username string) []string {
+	owners := []string{username}
+	for _, name := range UserOrgs(username) {
+		if OrgAccount(name) == username {
+			owners = append(owners, OrgOwner(name))
+		}
+	}
+	return owners
+}
+
+// UserUsage returns what username currently uses of each limit, with the
+// holes of the organizations it accounts for.
+func UserUsage(username string) map[string]int64 {
+	holes := make([]*HoleApp, 0)
+	for _, owner := range accountOwners(username) {
+		holes = append(holes, usershole.GetAll(owner)...)
+	}
+	var running int64
+	for _, hs := range holes {
+		if hs.Alive() {
+			running++
+		}
+	}
+	value, _ := usage.Get(transferKey(username, time.Now()))
+	transfer, _ := strconv.ParseInt(value, 10, 64)
+	connections.Lock()
+	conns := connections.count[username]
+	connections.Unlock()
+	return map[string]int64{
+		"holes":         int64(len(holes)),
+		"running_holes": running,
+		"ports":         int64(len(holes)),
+		"transfer":      transfer,
+		"connections":   conns,
+	}
+}
+
+// CheckQuota returns the name of the first limit username would go over by
+// adding the given amounts to its usage, or "" when all fit.
+func CheckQuota(username string, add map[string]int64) string {
+	limits := EffectiveLimits(username)
+	current := UserUsage(username)
+	for _, name := range LimitNames {
+		limit, ok := limits[name]
+		if !ok {
+			continue
+		}
+		if current[name]+add[name] > limit {
+			return name
+		}
+	}
+	return ""
+}
+
+// lockQuota takes the quota lock of the account username. It is held from
+// CheckQuota until the hole is created or started, so concurrent requests
+// do not all pass the check.
+func lockQuota(username string) func() {
+	return lockStore("quota:" + username)
+}
+
+// NewHoleAppInQuota creates a hole of owner when the account of owner has a
+// hole and a port left, or returns the name of the limit reached.
+func NewHoleAppInQuota(owner, holeName, scheme string, labels map[string]string) (*HoleApp, string, error) {
+	account := accountOf(owner)
+	defer lockQuota(account)()
+	if name := CheckQuota(account, map[string]int64{"holes": 1, "ports": 1}); name != "" {
+		return nil, name, nil
+	}
+	hs, err := usershole.NewHoleApp(owner, holeName, scheme, labels)
+	return hs, "", err
+}
+
+// StartInQuota starts the hole of owner when the account of owner may run
+// one more, or returns the name of the limit reached.
+func StartInQuota(owner string, hs *HoleApp) (string, error) {
+	account := accountOf(owner)
+	defer lockQuota(account)()
+	add := map[string]int64{"running_holes": 1}
+	if hs.Alive() {
+		add = nil
+	}
+	if name := CheckQuota(account, add); name != "" {
+		return name, nil
+	}
+	return "", hs.Start()
+}
+
+func quotaError(name string) map[string]string {
+	return errorMessage(17, "The "+name+" limit is reached.")
+}
+
+// limitFlag sets a default limit from the command line.
+type limitFlag string
+
+func (name limitFlag) String() string {
+	return strconv.FormatInt(defaultLimits[string(name)], 10)
+}
+
+func (name limitFlag) Set(value string) error {
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+	defaultLimits[string(name)] = limit
+	return nil
+}
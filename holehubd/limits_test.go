@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestNewHoleAppInQuotaRace(t *testing.T) {
+	openTestStore(t)
+	if err := SetUserLimit("alice", "holes", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	created := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hs, name, err := NewHoleAppInQuota("alice", "hole"+strconv.Itoa(i), "tcp", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if hs == nil {
+				if name != "holes" {
+					t.Error("limit reached is", name)
+				}
+				return
+			}
+			lock.Lock()
+			created++
+			lock.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 3 {
+		t.Fatalf("%d holes created, want 3", created)
+	}
+}
+
+func TestStartInQuotaRace(t *testing.T) {
+	openTestStore(t)
+	if err := SetUserLimit("alice", "running_holes", "2"); err != nil {
+		t.Fatal(err)
+	}
+	holes := make([]*HoleApp, 10)
+	for i := range holes {
+		hs, err := usershole.NewHoleApp("alice", "hole"+strconv.Itoa(i), "tcp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		holes[i] = hs
+	}
+
+	var wg sync.WaitGroup
+	for _, hs := range holes {
+		wg.Add(1)
+		go func(hs *HoleApp) {
+			defer wg.Done()
+			if _, err := StartInQuota("alice", hs); err != nil {
+				t.Error(err)
+			}
+		}(hs)
+	}
+	wg.Wait()
+
+	if n := UserUsage("alice")["running_holes"]; n != 2 {
+		t.Fatalf("%d holes running, want 2", n)
+	}
+	if name := CheckQuota("alice", map[string]int64{"running_holes": 1}); name != "running_holes" {
+		t.Fatal("limit reached is", name)
+	}
+}
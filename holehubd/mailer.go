@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/sendgrid/sendgrid-go"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var mailFrom string
+var mailFromName string
+
+// Mail is a message ready to hand to a Mailer.
+type Mail struct {
+	To      string
+	ToName  string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers mails. The backend is picked with the --mailer flag.
+type Mailer interface {
+	Send(mail *Mail) error
+}
+
+type MailerConfig struct {
+	Backend      string
+	SendGridUser string
+	SendGridKey  string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUser     string
+	SMTPPassword string
+	// SMTPPlaintext allows relays without STARTTLS.
+	SMTPPlaintext bool
+	Dir           string
+}
+
+func NewMailer(conf MailerConfig) (Mailer, error) {
+	switch conf.Backend {
+	case "sendgrid":
+		return &SendGridMailer{client: sendgrid.NewSendGridClient(conf.SendGridUser, conf.SendGridKey)}, nil
+	case "smtp":
+		if conf.SMTPHost == "" {
+			return nil, fmt.Errorf("mailer: smtp_host is required")
+		}
+		return &SMTPMailer{
+			Host:      conf.SMTPHost,
+			Port:      conf.SMTPPort,
+			User:      conf.SMTPUser,
+			Password:  conf.SMTPPassword,
+			Plaintext: conf.SMTPPlaintext,
+		}, nil
+	case "file":
+		return &FileMailer{Dir: conf.Dir}, nil
+	}
+	return nil, fmt.Errorf("mailer: unknown backend %q", conf.Backend)
+}
+
+type SendGridMailer struct {
+	client *sendgrid.SGClient
+}
+
+// checkAddress refuses a To that is not a bare address, which would end up
+// in the headers or in the name of a file.
+func (mail *Mail) checkAddress() error {
+	addr, err := netmail.ParseAddress(mail.To)
+	if err != nil || addr.Address != mail.To || addr.Name != "" || strings.ContainsAny(mail.To, "\r\n/\\") {
+		return fmt.Errorf("mailer: bad recipient %q", mail.To)
+	}
+	return nil
+}
+
+func (m *SendGridMailer) Send(mail *Mail) error {
+	if err := mail.checkAddress(); err != nil {
+		return err
+	}
+	message := sendgrid.NewMail()
+	message.AddTo(mail.To)
+	message.AddToName(mail.ToName)
+	message.SetSubject(mail.Subject)
+	message.SetText(mail.Text)
+	if mail.HTML != "" {
+		message.SetHTML(mail.HTML)
+	}
+	message.SetFrom(mailFrom)
+	message.SetFromName(mailFromName)
+	return m.client.Send(message)
+}
+
+// SMTPMailer sends through an SMTP relay. STARTTLS is required unless
+// Plaintext is set, and PLAIN auth is used when a user is set.
+type SMTPMailer struct {
+	Host      string
+	Port      int
+	User      string
+	Password  string
+	Plaintext bool
+}
+
+func (m *SMTPMailer) Send(mail *Mail) error {
+	if err := mail.checkAddress(); err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	} else if !m.Plaintext {
+		return fmt.Errorf("mailer: %s does not offer STARTTLS, set --smtp_plaintext to send without it", addr)
+	}
+	if m.User != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.User, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(mailFrom); err != nil {
+		return err
+	}
+	if err = c.Rcpt(mail.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(mail.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// FileMailer writes every mail to Dir as a .eml file, or to the log when
+// Dir is empty. It is meant for development and tests.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(mail *Mail) error {
+	if err := mail.checkAddress(); err != nil {
+		return err
+	}
+	if m.Dir == "" {
+		log.Printf("mail to %s <%s>\n%s", mail.ToName, mail.To, mail.Bytes())
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+	fileName := fmt.Sprintf("%s/%d-%s.eml", m.Dir, time.Now().UnixNano(), mail.To)
+	return ioutil.WriteFile(fileName, mail.Bytes(), 0600)
+}
+
+func encodeAddress(name, addr string) string {
+	if name == "" {
+		return "<" + addr + ">"
+	}
+	return mime.QEncoding.Encode("utf-8", name) + " <" + addr + ">"
+}
+
+func writeMailPart(w io.Writer, text string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(text))
+	qp.Close()
+}
+
+// Bytes renders the mail as an RFC 5322 message. Mails with an HTML body
+// are sent as multipart/alternative with the text part first.
+func (mail *Mail) Bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", encodeAddress(mailFromName, mailFrom))
+	fmt.Fprintf(&buf, "To: %s\r\n", encodeAddress(mail.ToName, mail.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if mail.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeMailPart(&buf, mail.Text)
+		return buf.Bytes()
+	}
+
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", mail.Text},
+		{"text/html; charset=utf-8", mail.HTML},
+	} {
+		pw, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeMailPart(pw, part.body)
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+// sendMail queues mail in the outbox; RunOutbox delivers it.
+func sendMail(mail *Mail) bool {
+	QueueMail(mail)
+	return true
+}
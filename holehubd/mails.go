@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"regexp"
+	"text/template"
+)
+
+var baseURL string
+var defaultLocale string
+
+var reLocale = regexp.MustCompile("^[A-Za-z]{2,3}([_-][A-Za-z]{2,4})?$")
+
+// mailTemplate returns the path of the template name.ext for locale, or for
+// the default locale when the user's locale has no such template.
+func mailTemplate(locale, name, ext string) string {
+	if reLocale.MatchString(locale) {
+		fileName := configPath + "mails/" + locale + "/" + name + ext
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName
+		}
+	}
+	return configPath + "mails/" + defaultLocale + "/" + name + ext
+}
+
+// userLocale returns the locale stored on the user, or the default one.
+func userLocale(username string) string {
+	locale, _ := userstate.Users().Get(username, "locale")
+	if locale == "" {
+		return defaultLocale
+	}
+	return locale
+}
+
+// RenderMail fills the mail template name from config_dir/mails/<locale>/.
+// The text template <name>.txt defines a "subject" block next to the text
+// body; <name>.html is optional and becomes the HTML part.
+func RenderMail(locale, name string, data map[string]interface{}) (*Mail, error) {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["BaseURL"] = baseURL
+
+	mail := new(Mail)
+	tpl, err := template.ParseFiles(mailTemplate(locale, name, ".txt"))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = tpl.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return nil, err
+	}
+	mail.Subject = string(bytes.TrimSpace(buf.Bytes()))
+	buf.Reset()
+	if err = tpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	mail.Text = string(bytes.TrimSpace(buf.Bytes()))
+
+	htmlFile := mailTemplate(locale, name, ".html")
+	if _, err = os.Stat(htmlFile); err != nil {
+		return mail, nil
+	}
+	htmlTpl, err := htmltemplate.ParseFiles(htmlFile)
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	if err = htmlTpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	mail.HTML = buf.String()
+	return mail, nil
+}
+
+// SendTemplateMail renders the template name in the user's locale and
+// sends it to email.
+func SendTemplateMail(username, email, name string, data map[string]interface{}) bool {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["Username"] = username
+	mail, err := RenderMail(userLocale(username), name, data)
+	if err != nil {
+		log.Println("render mail", name, "failed", err)
+		return false
+	}
+	mail.To = email
+	mail.ToName = username
+	return sendMail(mail)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are kept here and written in the Prometheus text format at
+// /metrics, for admins and for scrapers holding --metrics_token. Labels
+// never carry user ids, and only the per-hole series carry hole ids: those
+// are written for the running holes alone, so the series stay bounded by
+// the running holes quota.
+
+var metricsToken string
+
+type metricVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]float64
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func labelKey(labels []string, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + "=" + strconv.Quote(values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	m.Lock()
+	m.values[labelKey(m.labels, labelValues)] += v
+	m.Unlock()
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) Set(v float64, labelValues ...string) {
+	m.Lock()
+	m.values[labelKey(m.labels, labelValues)] = v
+	m.Unlock()
+}
+
+// Delete drops the series with the given label values.
+func (m *metricVec) Delete(labelValues ...string) {
+	m.Lock()
+	delete(m.values, labelKey(m.labels, labelValues))
+	m.Unlock()
+}
+
+// Reset drops every series, for gauges that are filled at scrape time.
+func (m *metricVec) Reset() {
+	m.Lock()
+	m.values = make(map[string]float64)
+	m.Unlock()
+}
+
+func writeSeries(buf *bytes.Buffer, name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(buf, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (m *metricVec) write(buf *bytes.Buffer) {
+	m.Lock()
+	defer m.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeSeries(buf, m.name, key, m.values[key])
+	}
+}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets map[string][]uint64
+	sums    map[string]float64
+	counts  map[string]uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		counts:  make(map[string]uint64),
+	}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.buckets[key]; !ok {
+		h.buckets[key] = make([]uint64, len(latencyBuckets))
+	}
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.buckets[key][i]++
+		}
+	}
+	h.sums[key] += v
+	h.counts[key]++
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.counts))
+	for key := range h.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sep := ""
+		if key != "" {
+			sep = ","
+		}
+		for i, le := range latencyBuckets {
+			writeSeries(buf, h.name+"_bucket", key+sep+"le="+strconv.Quote(strconv.FormatFloat(le, 'g', -1, 64)), float64(h.buckets[key][i]))
+		}
+		writeSeries(buf, h.name+"_bucket", key+sep+`le="+Inf"`, float64(h.counts[key]))
+		writeSeries(buf, h.name+"_sum", key, h.sums[key])
+		writeSeries(buf, h.name+"_count", key, float64(h.counts[key]))
+	}
+}
+
+var (
+	httpRequests = newMetricVec("counter", "holehub_http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "code")
+	httpLatency = newHistogramVec("holehub_http_request_duration_seconds",
+		"HTTP request latency by route and method.", "route", "method")
+	signins = newMetricVec("counter", "holehub_signins_total",
+		"Sign ins by result.", "result")
+	mailsSent = newMetricVec("counter", "holehub_mails_total",
+		"Mail delivery attempts by result.", "result")
+	holeStarts = newMetricVec("counter", "holehub_hole_starts_total",
+		"Holes started; restart counts starts of a hole that was already running.", "kind")
+	holeCount = newMetricVec("gauge", "holehub_holes",
+		"Holes by state.", "state")
+	portUsage = newMetricVec("gauge", "holehub_ports",
+		"Hole ports by allocator state.", "state")
+	holeBytes = newMetricVec("counter", "holehub_hole_bytes_total",
+		"Bytes through the holes by direction, as reported by the hole servers.", "direction")
+	holeConnections = newMetricVec("gauge", "holehub_hole_connections",
+		"Open public connections of the holes, as last reported by the hole servers.")
+	runningHoleBytes = newMetricVec("counter", "holehub_running_hole_bytes_total",
+		"Bytes through each running hole by direction since holehubd started.", "hole", "direction")
+	runningHoleConnections = newMetricVec("gauge", "holehub_running_hole_connections",
+		"Open public connections of each running hole, as last reported by its hole server.", "hole")
+)
+
+// holeTraffic keeps the bytes of each hole since holehubd started, for the
+// per-hole series.
+var holeTraffic = struct {
+	sync.Mutex
+	bytes map[string][2]int64
+}{bytes: make(map[string][2]int64)}
+
+func countHoleBytes(holeID string, in, out int64) {
+	holeTraffic.Lock()
+	bytes := holeTraffic.bytes[holeID]
+	holeTraffic.bytes[holeID] = [2]int64{bytes[0] + in, bytes[1] + out}
+	holeTraffic.Unlock()
+}
+
+// forgetHoleBytes drops the bytes of a removed hole.
+func forgetHoleBytes(holeID string) {
+	holeTraffic.Lock()
+	delete(holeTraffic.bytes, holeID)
+	holeTraffic.Unlock()
+}
+
+// collectHoleMetrics fills the gauges that are read from the store at
+// scrape time.
+func collectHoleMetrics() {
+	holeIDs, _ := usershole.holes.GetAll()
+	running := make([]string, 0)
+	for _, holeID := range holeIDs {
+		if (&HoleApp{ID: holeID}).Alive() {
+			running = append(running, holeID)
+		}
+	}
+	holeCount.Set(float64(len(running)), "running")
+	holeCount.Set(float64(len(holeIDs)-len(running)), "stopped")
+
+	lastport, _ := usershole.seq.Get("holeserverport")
+	last, _ := strconv.Atoi(lastport)
+	freePorts, _ := usershole.freePorts.GetAll()
+	allocated := 0
+	if last >= minPort {
+		allocated = last - minPort + 1
+	}
+	portUsage.Set(float64(allocated-len(freePorts)), "used")
+	portUsage.Set(float64(len(freePorts)), "free")
+
+	var open int64
+	openConnections.Lock()
+	for _, n := range openConnections.holes {
+		open += n
+	}
+	runningHoleConnections.Reset()
+	for _, holeID := range running {
+		runningHoleConnections.Set(float64(openConnections.holes[holeID]), holeID)
+	}
+	openConnections.Unlock()
+	holeConnections.Set(float64(open))
+
+	runningHoleBytes.Reset()
+	holeTraffic.Lock()
+	for _, holeID := range running {
+		bytes := holeTraffic.bytes[holeID]
+		runningHoleBytes.Set(float64(bytes[0]), holeID, "in")
+		runningHoleBytes.Set(float64(bytes[1]), holeID, "out")
+	}
+	holeTraffic.Unlock()
+}
+
+// metricsAllowed tells if req may read the metrics: an admin session, or
+// the bearer token set with --metrics_token.
+func metricsAllowed(req *http.Request) bool {
+	if metricsToken != "" && tokenEqual(req.Header.Get("Authorization"), "Bearer "+metricsToken) {
+		return true
+	}
+	return userstate.AdminRights(req)
+}
+
+func MetricsHandler(w http.ResponseWriter, req *http.Request) {
+	if !metricsAllowed(req) {
+		http.Error(w, "Permission denied.", http.StatusForbidden)
+		return
+	}
+	collectHoleMetrics()
+	var buf bytes.Buffer
+	for _, m := range []*metricVec{httpRequests, signins, mailsSent, holeStarts, holeCount, portUsage, holeBytes, holeConnections, runningHoleBytes, runningHoleConnections} {
+		m.write(&buf)
+	}
+	httpLatency.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// MetricsMiddleware counts requests and their latency per route template,
+// so /api/holes/{holeID}/ is one series and not one per hole.
+func MetricsMiddleware(router *mux.Router) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		route := "other"
+		var match mux.RouteMatch
+		if router.Match(req, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		start := time.Now()
+		rw := negroni.NewResponseWriter(w)
+		next(rw, req)
+		httpRequests.Inc(route, req.Method, strconv.Itoa(rw.Status()))
+		httpLatency.Observe(time.Since(start).Seconds(), route, req.Method)
+	}
+}
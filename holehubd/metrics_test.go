@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	metricsToken = "secret"
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	MetricsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal("metrics answered", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsToken(t *testing.T) {
+	openTestStore(t)
+	metricsToken = "secret"
+	for _, header := range []string{"", "secret", "Bearer secre", "Bearer secret2"} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		MetricsHandler(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("metrics with %q answered %d", header, w.Code)
+		}
+	}
+	scrapeMetrics(t)
+}
+
+func TestRunningHoleMetrics(t *testing.T) {
+	openTestStore(t)
+	running, err := usershole.NewHoleApp("alice", "running", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped, err := usershole.NewHoleApp("alice", "stopped", "tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := running.Start(); err != nil {
+		t.Fatal(err)
+	}
+	RecordTraffic(running.ID, TrafficSample{BytesIn: 10, BytesOut: 20, Open: 3})
+	RecordTraffic(stopped.ID, TrafficSample{BytesIn: 5, BytesOut: 5, Open: 1})
+
+	body := scrapeMetrics(t)
+	for _, series := range []string{
+		`holehub_running_hole_bytes_total{hole="` + running.ID + `",direction="in"} 10`,
+		`holehub_running_hole_bytes_total{hole="` + running.ID + `",direction="out"} 20`,
+		`holehub_running_hole_connections{hole="` + running.ID + `"} 3`,
+	} {
+		if !strings.Contains(body, series+"\n") {
+			t.Error("missing", series)
+		}
+	}
+	if strings.Contains(body, stopped.ID) {
+		t.Error("stopped hole has series")
+	}
+
+	usershole.Remove("alice", running.ID)
+	if strings.Contains(scrapeMetrics(t), running.ID) {
+		t.Error("removed hole has series")
+	}
+}
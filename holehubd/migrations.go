@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/xyproto/pinterface"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// meta keeps the schema version of the store. Migrate brings older stores up
+// to date at start; each migration runs once and in order.
+var meta pinterface.IKeyValue
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      func() error
+}
+
+var migrations = []Migration{
+	{1, "index holes by owner and name, stamp hole records", migrateHoleIndex},
+	{2, "index the connection log by hole and day", migrateConnectionIndex},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func SchemaVersion() int {
+	value, _ := meta.Get("schema_version")
+	version, _ := strconv.Atoi(value)
+	return version
+}
+
+// Migrate applies the migrations newer than the schema version of the store.
+func Migrate() error {
+	version := SchemaVersion()
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("Store schema version %d is newer than this holehubd supports (%d)", version, latestSchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		log.Printf("migrate: %d %s\n", m.Version, m.Name)
+		if err := m.Up(); err != nil {
+			return fmt.Errorf("migration %d %s failed: %s", m.Version, m.Name, err)
+		}
+		meta.Set("schema_version", strconv.Itoa(m.Version))
+	}
+	return nil
+}
+
+// migrateHoleIndex moves the comma separated hole lists of the users and
+// organizations to hole_index, and gives every hole its owner and
+// timestamps.
+func migrateHoleIndex() error {
+	h := usershole
+	defer h.lockWrite()()
+	for _, owner := range allOwners() {
+		record, key, _ := h.ownerRecord(owner)
+		userholes, _ := record.Get(key, "holes")
+		for _, holeID := range splitList(userholes) {
+			rec := h.GetRecord(holeID)
+			if rec == nil {
+				log.Println("migrate: drop missing hole", holeID, "of", owner)
+				continue
+			}
+			rec.Owner = owner
+			h.saveRecord(rec)
+			h.indexAdd(owner, rec.Name, holeID)
+		}
+		record.DelKey(key, "holes")
+	}
+	return nil
+}
+
+// migrateConnectionIndex indexes the connection log written before
+// connection_index.
+func migrateConnectionIndex() error {
+	byHole := make(map[string]map[string][]string)
+	keys, _ := connectionLog.GetAll()
+	for _, key := range keys {
+		parts := strings.Split(key, ":")
+		if len(parts) != 2 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if byHole[parts[0]] == nil {
+			byHole[parts[0]] = make(map[string][]string)
+		}
+		day := connectionDay(time.Unix(0, nanos))
+		byHole[parts[0]][day] = append(byHole[parts[0]][day], key)
+	}
+	for holeID, days := range byHole {
+		list := make([]string, 0, len(days))
+		for day, keys := range days {
+			list = append(list, day)
+			set := connectionDaySet(holeID, day)
+			for _, key := range keys {
+				set.Add(key)
+			}
+		}
+		sort.Strings(list)
+		setConnectionDays(holeID, list)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMigrateHoleIndex(t *testing.T) {
+	openTestStore(t)
+	if err := CreateOrg("acme", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holes as stored before version 1: comma separated lists on the owners
+	// and records without owner or timestamps.
+	for _, holeID := range []string{"hole1", "hole2", "hole3"} {
+		usershole.holes.Set(holeID, "name", "web")
+		usershole.holes.Set(holeID, "scheme", "tcp")
+		usershole.holes.Set(holeID, "port", "10000")
+	}
+	userstate.Users().Set("alice", "holes", "hole1,hole2,missing")
+	usershole.orgs.Set("acme", "holes", "hole3")
+	meta.Del("schema_version")
+
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if version := SchemaVersion(); version != latestSchemaVersion() {
+		t.Fatal("schema version is", version)
+	}
+	if ids := usershole.HoleIDs("alice"); len(ids) != 2 || ids[0] != "hole1" || ids[1] != "hole2" {
+		t.Fatal("holes of alice are", ids)
+	}
+	if ids := usershole.HoleIDsByName("alice", "web"); len(ids) != 2 {
+		t.Fatal("holes of alice called web are", ids)
+	}
+	if ids := usershole.HoleIDs(OrgOwner("acme")); len(ids) != 1 || ids[0] != "hole3" {
+		t.Fatal("holes of acme are", ids)
+	}
+	rec := usershole.GetRecord("hole3")
+	if rec.Owner != OrgOwner("acme") || rec.CreatedAt == 0 || rec.Port != "10000" {
+		t.Fatal("migrated record is", rec)
+	}
+	if ok, _ := userstate.Users().Has("alice", "holes"); ok {
+		t.Error("hole list of alice kept")
+	}
+	if ok, _ := usershole.orgs.Has("acme", "holes"); ok {
+		t.Error("hole list of acme kept")
+	}
+
+	// Migrations run once.
+	usershole.holes.Set("hole1", "owner", "bob")
+	if err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := usershole.holes.Get("hole1", "owner"); owner != "bob" {
+		t.Error("migration ran twice")
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	openTestStore(t)
+	meta.Set("schema_version", strconv.Itoa(latestSchemaVersion()+1))
+	if err := Migrate(); err == nil {
+		t.Fatal("store of a newer schema migrated")
+	}
+}
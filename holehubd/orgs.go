@@ -0,0 +1,424 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Holes of an organization are owned by org:<name>. Its certificates are
+// kept under certs/org-<name>-*.
+const orgPrefix = "org:"
+
+var reOrgName = regexp.MustCompile("^[A-Za-z0-9][-_A-Za-z0-9]{0,38}$")
+
+var reUsername = regexp.MustCompile("^[A-Za-z0-9][-_.A-Za-z0-9]{0,38}$")
+
+// ValidUsername reports if name can be a user. Names with a : or starting
+// with org- would share the owner and certificate names of organizations.
+func ValidUsername(name string) bool {
+	return reUsername.MatchString(name) && !strings.HasPrefix(strings.ToLower(name), "org-")
+}
+
+// roleLevels orders the organization roles. Viewers see the holes, members
+// also create, start and kill them, admins remove holes and manage members,
+// and owners manage owners and delete the organization.
+var roleLevels = map[string]int{
+	"viewer": 1,
+	"member": 2,
+	"admin":  3,
+	"owner":  4,
+}
+
+func orgName(owner string) (string, bool) {
+	if strings.HasPrefix(owner, orgPrefix) {
+		return owner[len(orgPrefix):], true
+	}
+	return "", false
+}
+
+func OrgOwner(name string) string {
+	return orgPrefix + name
+}
+
+// certName is the prefix of the certificate files of owner.
+func certName(owner string) string {
+	if name, ok := orgName(owner); ok {
+		return "org-" + name
+	}
+	return owner
+}
+
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func addToList(list, item string) string {
+	if strings.Contains(","+list, ","+item+",") {
+		return list
+	}
+	return list + item + ","
+}
+
+func removeFromList(list, item string) string {
+	return strings.TrimPrefix(strings.Replace(","+list, ","+item+",", ",", 1), ",")
+}
+
+func OrgExists(name string) bool {
+	ok, _ := usershole.orgs.Exists(name)
+	return ok
+}
+
+// OrgRole returns the role of username in the organization, or "".
+func OrgRole(name, username string) string {
+	role, _ := usershole.orgs.Get(name, "role_"+username)
+	return role
+}
+
+// HasOrgRole tells if username has at least role in the organization.
+func HasOrgRole(name, username, role string) bool {
+	return roleLevels[OrgRole(name, username)] >= roleLevels[role]
+}
+
+type OrgMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func OrgMembers(name string) []OrgMember {
+	list, _ := usershole.orgs.Get(name, "members")
+	members := make([]OrgMember, 0)
+	for _, username := range splitList(list) {
+		members = append(members, OrgMember{username, OrgRole(name, username)})
+	}
+	return members
+}
+
+// UserOrgs returns the organizations username belongs to.
+func UserOrgs(username string) []string {
+	list, _ := userstate.Users().Get(username, "orgs")
+	orgs := splitList(list)
+	sort.Strings(orgs)
+	return orgs
+}
+
+// OrgAccount returns the user the holes of the organization count against,
+// its creator or, once that account is gone, its first owner.
+func OrgAccount(name string) string {
+	creator, _ := usershole.orgs.Get(name, "created_by")
+	if creator != "" && userstate.HasUser(creator) {
+		return creator
+	}
+	for _, member := range OrgMembers(name) {
+		if member.Role == "owner" {
+			return member.Username
+		}
+	}
+	return ""
+}
+
+// CreateOrg creates the organization with owner as its first owner and
+// generates the organization CA and certificate.
+func CreateOrg(name, owner string) error {
+	if !reOrgName.MatchString(name) {
+		return fmt.Errorf("Organization name format error")
+	}
+	if OrgExists(name) {
+		return fmt.Errorf("Organization is already exists.")
+	}
+	usershole.orgs.Set(name, "created_by", owner)
+	SetOrgMember(name, owner, "owner")
+	prefix := certName(OrgOwner(name))
+	GenerateUserCa(prefix)
+	GenerateUserCert(prefix)
+	return nil
+}
+
+// SetOrgMember adds username to the organization or changes its role.
+func SetOrgMember(name, username, role string) error {
+	defer lockStore("org:" + name)()
+	if role != "owner" && OrgRole(name, username) == "owner" && orgOwnerCount(name) == 1 {
+		return errLastOwner
+	}
+	orgs := usershole.orgs
+	members, _ := orgs.Get(name, "members")
+	orgs.Set(name, "members", addToList(members, username))
+	orgs.Set(name, "role_"+username, role)
+	users := userstate.Users()
+	list, _ := users.Get(username, "orgs")
+	users.Set(username, "orgs", addToList(list, name))
+	return nil
+}
+
+var errLastOwner = errors.New("The organization needs an owner")
+
+func orgOwnerCount(name string) int {
+	count := 0
+	for _, member := range OrgMembers(name) {
+		if member.Role == "owner" {
+			count++
+		}
+	}
+	return count
+}
+
+// RemoveOrgMember removes username from the organization. The organization
+// is deleted when its last owner leaves.
+func RemoveOrgMember(name, username string) {
+	defer lockStore("org:" + name)()
+	orgs := usershole.orgs
+	members, _ := orgs.Get(name, "members")
+	orgs.Set(name, "members", removeFromList(members, username))
+	orgs.DelKey(name, "role_"+username)
+	users := userstate.Users()
+	list, _ := users.Get(username, "orgs")
+	users.Set(username, "orgs", removeFromList(list, name))
+
+	if orgOwnerCount(name) == 0 {
+		DeleteOrg(name)
+	}
+}
+
+// DeleteOrg removes the organization with its holes and certificates.
+func DeleteOrg(name string) {
+	usershole.RemoveAll(OrgOwner(name))
+	users := userstate.Users()
+	for _, member := range OrgMembers(name) {
+		list, _ := users.Get(member.Username, "orgs")
+		users.Set(member.Username, "orgs", removeFromList(list, name))
+	}
+	prefix := certName(OrgOwner(name))
+	for _, suffix := range []string{"-ca.pem", "-ca.key", "-cert.pem", "-cert.key"} {
+		certFile := configPath + "certs/" + prefix + suffix
+		if err := os.Remove(certFile); err != nil && !os.IsNotExist(err) {
+			log.Println("remove", certFile, "failed", err)
+		}
+	}
+	usershole.orgs.Del(name)
+}
+
+func OrgRoutes(router *mux.Router, r *render.Render) {
+	// orgAccess checks that the organization of the path exists and the
+	// user has at least role in it.
+	orgAccess := func(w http.ResponseWriter, req *http.Request, role string) (string, bool) {
+		name := mux.Vars(req)["org"]
+		if !OrgExists(name) {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[21])
+			return "", false
+		}
+		if !HasOrgRole(name, userstate.Username(req), role) {
+			r.JSON(w, http.StatusForbidden, ErrorMessages[22])
+			return "", false
+		}
+		return name, true
+	}
+
+	router.HandleFunc("/api/orgs/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		members := make([]map[string]string, 0)
+		for _, name := range UserOrgs(username) {
+			members = append(members, map[string]string{"org": name, "role": OrgRole(name, username)})
+		}
+		r.JSON(w, http.StatusOK, map[string][]map[string]string{"orgs": members})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/orgs/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		req.ParseForm()
+		name := req.Form.Get("name")
+		if !reOrgName.MatchString(name) {
+			r.JSON(w, http.StatusOK, ErrorMessages[23])
+			return
+		}
+		if err := CreateOrg(name, username); err != nil {
+			r.JSON(w, http.StatusOK, ErrorMessages[20])
+			return
+		}
+		Audit(username, "org.create", name, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/orgs/{org}/", func(w http.ResponseWriter, req *http.Request) {
+		name, ok := orgAccess(w, req, "viewer")
+		if !ok {
+			return
+		}
+		r.JSON(w, http.StatusOK, map[string]interface{}{"org": name, "members": OrgMembers(name)})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/orgs/{org}/", func(w http.ResponseWriter, req *http.Request) {
+		name, ok := orgAccess(w, req, "owner")
+		if !ok {
+			return
+		}
+		DeleteOrg(name)
+		Audit(userstate.Username(req), "org.delete", name, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("DELETE")
+
+	router.HandleFunc("/api/orgs/{org}/members/", func(w http.ResponseWriter, req *http.Request) {
+		name, ok := orgAccess(w, req, "admin")
+		if !ok {
+			return
+		}
+		req.ParseForm()
+		member := req.Form.Get("username")
+		role := req.Form.Get("role")
+		if _, ok := roleLevels[role]; !ok {
+			r.JSON(w, http.StatusOK, ErrorMessages[24])
+			return
+		}
+		if !userstate.HasUser(member) {
+			r.JSON(w, http.StatusOK, ErrorMessages[7])
+			return
+		}
+		// Only owners hand out or take away ownership.
+		username := userstate.Username(req)
+		if (role == "owner" || OrgRole(name, member) == "owner") && !HasOrgRole(name, username, "owner") {
+			r.JSON(w, http.StatusForbidden, ErrorMessages[22])
+			return
+		}
+		if err := SetOrgMember(name, member, role); err != nil {
+			r.JSON(w, http.StatusOK, ErrorMessages[42])
+			return
+		}
+		Audit(username, "org.member.set", name+"/"+member+"="+role, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+
+	router.HandleFunc("/api/orgs/{org}/members/{username}", func(w http.ResponseWriter, req *http.Request) {
+		name, ok := orgAccess(w, req, "admin")
+		if !ok {
+			return
+		}
+		member := mux.Vars(req)["username"]
+		username := userstate.Username(req)
+		if OrgRole(name, member) == "" {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[7])
+			return
+		}
+		if OrgRole(name, member) == "owner" && !HasOrgRole(name, username, "owner") {
+			r.JSON(w, http.StatusForbidden, ErrorMessages[22])
+			return
+		}
+		RemoveOrgMember(name, member)
+		Audit(username, "org.member.remove", name+"/"+member, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("DELETE")
+
+	for _, file := range []string{"ca.pem", "cert.pem", "cert.key"} {
+		file := file
+		router.HandleFunc("/api/orgs/{org}/"+file, func(w http.ResponseWriter, req *http.Request) {
+			name, ok := orgAccess(w, req, "member")
+			if !ok {
+				return
+			}
+			data, _ := ioutil.ReadFile(configPath + "certs/" + certName(OrgOwner(name)) + "-" + file)
+			r.Data(w, http.StatusOK, data)
+		}).Methods("GET")
+	}
+
+	router.HandleFunc("/api/orgs/{org}/holes/", func(w http.ResponseWriter, req *http.Request) {
+		name, ok := orgAccess(w, req, "viewer")
+		if !ok {
+			return
+		}
+		holes := usershole.GetAll(OrgOwner(name))
+		r.JSON(w, http.StatusOK, map[string][]*HoleApp{"holes": holes})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/orgs/{org}/holes/create/", func(w http.ResponseWriter, req *http.Request) {
+		name, ok := orgAccess(w, req, "member")
+		if !ok {
+			return
+		}
+		req.ParseForm()
+		labels, ok := parseLabels(req.Form.Get("labels"))
+		if !ok {
+			r.JSON(w, http.StatusOK, ErrorMessages[34])
+			return
+		}
+		hs, quota, err := NewHoleAppInQuota(OrgOwner(name), req.Form.Get("name"), req.Form.Get("scheme"), labels)
+		if quota != "" {
+			r.JSON(w, http.StatusOK, quotaError(quota))
+			return
+		}
+		if err != nil {
+			holeCreateError(w, r, err)
+			return
+		}
+		Audit(userstate.Username(req), "hole.create", hs.ID, req)
+		r.JSON(w, http.StatusOK, map[string]HoleApp{"hole": *hs})
+	}).Methods("POST")
+
+	router.HandleFunc("/api/orgs/{org}/holes/{holeID}/", func(w http.ResponseWriter, req *http.Request) {
+		name, ok := orgAccess(w, req, "viewer")
+		if !ok {
+			return
+		}
+		hs := usershole.GetOne(OrgOwner(name), mux.Vars(req)["holeID"])
+		if hs == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		r.JSON(w, http.StatusOK, hs)
+	}).Methods("GET")
+
+	for _, command := range []string{"start", "kill", "remove"} {
+		command := command
+		role := "member"
+		if command == "remove" {
+			role = "admin"
+		}
+		router.HandleFunc("/api/orgs/{org}/holes/{holeID}/"+command+"/", func(w http.ResponseWriter, req *http.Request) {
+			name, ok := orgAccess(w, req, role)
+			if !ok {
+				return
+			}
+			owner := OrgOwner(name)
+			holeID := mux.Vars(req)["holeID"]
+			hs := usershole.GetOne(owner, holeID)
+			if hs == nil {
+				r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+				return
+			}
+			var err error
+			switch command {
+			case "start":
+				var quota string
+				if quota, err = StartInQuota(owner, hs); quota != "" {
+					r.JSON(w, http.StatusOK, quotaError(quota))
+					return
+				}
+				if err != nil {
+					holeStartError(w, r, holeID, err)
+					return
+				}
+			case "kill":
+				err = hs.Kill()
+			case "remove":
+				err = usershole.Remove(owner, holeID)
+			}
+			if err != nil {
+				r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+				return
+			}
+			Audit(userstate.Username(req), "hole."+command, holeID, req)
+			r.JSON(w, http.StatusOK, ErrorMessages[0])
+		}).Methods("POST")
+	}
+}
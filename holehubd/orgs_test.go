@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestLastOwnerStays(t *testing.T) {
+	openTestStore(t)
+	userstate.AddUser("bob", "secret", "bob@example.com")
+	if err := CreateOrg("acme", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, role := range []string{"admin", "member", "viewer"} {
+		if err := SetOrgMember("acme", "alice", role); err != errLastOwner {
+			t.Fatalf("last owner made %s: %v", role, err)
+		}
+	}
+	if role := OrgRole("acme", "alice"); role != "owner" {
+		t.Fatal("last owner is", role)
+	}
+
+	if err := SetOrgMember("acme", "bob", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetOrgMember("acme", "alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetOrgMember("acme", "bob", "member"); err != errLastOwner {
+		t.Fatal("last owner made member:", err)
+	}
+
+	RemoveOrgMember("acme", "alice")
+	if !OrgExists("acme") {
+		t.Fatal("organization with an owner deleted")
+	}
+	RemoveOrgMember("acme", "bob")
+	if OrgExists("acme") {
+		t.Fatal("organization without owner kept")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"github.com/satori/go.uuid"
+	"github.com/xyproto/pinterface"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The outbox keeps every mail in the store until the mailer accepted it, so
+// a provider outage delays mails instead of losing them. Mails carry reset
+// tokens and confirmation codes, so the body is dropped once sent and the
+// entries are dropped after outboxKeepSent or outboxKeepDead.
+var outbox pinterface.IHashMap
+var outboxPending pinterface.ISet
+
+var outboxInterval = 10 * time.Second
+var outboxMaxAttempts = 10
+var outboxMinBackoff = 30 * time.Second
+var outboxMaxBackoff = 6 * time.Hour
+var outboxKeepSent = 7 * 24 * time.Hour
+var outboxKeepDead = 30 * 24 * time.Hour
+
+const (
+	MailPending = "pending"
+	MailSent    = "sent"
+	MailDead    = "dead"
+)
+
+type OutboxMail struct {
+	ID        string
+	To        string
+	ToName    string
+	Subject   string
+	Status    string
+	Attempts  int
+	NextAt    int64
+	CreatedAt int64
+	SentAt    int64
+	LastError string
+}
+
+// QueueMail stores mail in the outbox to be sent in the background.
+func QueueMail(mail *Mail) string {
+	id := uuid.NewV4().String()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	outbox.Set(id, "to", mail.To)
+	outbox.Set(id, "to_name", mail.ToName)
+	outbox.Set(id, "subject", mail.Subject)
+	outbox.Set(id, "text", mail.Text)
+	outbox.Set(id, "html", mail.HTML)
+	outbox.Set(id, "status", MailPending)
+	outbox.Set(id, "attempts", "0")
+	outbox.Set(id, "next_at", now)
+	outbox.Set(id, "created_at", now)
+	outboxPending.Add(id)
+	return id
+}
+
+func getOutboxInt(id, key string) int64 {
+	value, _ := outbox.Get(id, key)
+	i, _ := strconv.ParseInt(value, 10, 64)
+	return i
+}
+
+func GetOutboxMail(id string) *OutboxMail {
+	if ok, _ := outbox.Exists(id); !ok {
+		return nil
+	}
+	m := &OutboxMail{ID: id}
+	m.To, _ = outbox.Get(id, "to")
+	m.ToName, _ = outbox.Get(id, "to_name")
+	m.Subject, _ = outbox.Get(id, "subject")
+	m.Status, _ = outbox.Get(id, "status")
+	m.LastError, _ = outbox.Get(id, "last_error")
+	m.Attempts = int(getOutboxInt(id, "attempts"))
+	m.NextAt = getOutboxInt(id, "next_at")
+	m.CreatedAt = getOutboxInt(id, "created_at")
+	m.SentAt = getOutboxInt(id, "sent_at")
+	return m
+}
+
+// ListOutbox returns the mails in the outbox with the given status, or all
+// of them when status is empty, oldest first.
+func ListOutbox(status string) []*OutboxMail {
+	ids, _ := outbox.GetAll()
+	mails := make([]*OutboxMail, 0)
+	for _, id := range ids {
+		m := GetOutboxMail(id)
+		if m == nil || (status != "" && m.Status != status) {
+			continue
+		}
+		mails = append(mails, m)
+	}
+	sort.Slice(mails, func(i, j int) bool { return mails[i].CreatedAt < mails[j].CreatedAt })
+	return mails
+}
+
+// ResendMail puts a dead mail back in the queue. Sent mails lost their
+// body and can not be sent again.
+func ResendMail(id string) bool {
+	if status, _ := outbox.Get(id, "status"); status != MailDead {
+		return false
+	}
+	outbox.Set(id, "status", MailPending)
+	outbox.Set(id, "attempts", "0")
+	outbox.Set(id, "next_at", strconv.FormatInt(time.Now().Unix(), 10))
+	outbox.DelKey(id, "last_error")
+	outboxPending.Add(id)
+	return true
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+func deliverOutboxMail(id string) {
+	mail := new(Mail)
+	mail.To, _ = outbox.Get(id, "to")
+	mail.ToName, _ = outbox.Get(id, "to_name")
+	mail.Subject, _ = outbox.Get(id, "subject")
+	mail.Text, _ = outbox.Get(id, "text")
+	mail.HTML, _ = outbox.Get(id, "html")
+
+	now := time.Now()
+	err := mailer.Send(mail)
+	if err == nil {
+		mailsSent.Inc("sent")
+		log.Println("mail sent to", mail.To)
+		outbox.Set(id, "status", MailSent)
+		outbox.Set(id, "sent_at", strconv.FormatInt(now.Unix(), 10))
+		outbox.DelKey(id, "last_error")
+		outbox.DelKey(id, "text")
+		outbox.DelKey(id, "html")
+		outboxPending.Del(id)
+		return
+	}
+
+	mailsSent.Inc("failed")
+	attempts := int(getOutboxInt(id, "attempts")) + 1
+	log.Println("send mail to", mail.To, "failed", attempts, "times", err)
+	outbox.Set(id, "attempts", strconv.Itoa(attempts))
+	outbox.Set(id, "last_error", err.Error())
+	if attempts >= outboxMaxAttempts {
+		outbox.Set(id, "status", MailDead)
+		outboxPending.Del(id)
+		return
+	}
+	outbox.Set(id, "next_at", strconv.FormatInt(now.Add(outboxBackoff(attempts)).Unix(), 10))
+}
+
+// DrainOutbox sends every pending mail that is due and drops the sent mails
+// older than outboxKeepSent and the dead ones older than outboxKeepDead.
+func DrainOutbox() {
+	now := time.Now().Unix()
+	ids, _ := outboxPending.GetAll()
+	for _, id := range ids {
+		if getOutboxInt(id, "next_at") > now {
+			continue
+		}
+		deliverOutboxMail(id)
+	}
+
+	sentExpired := time.Now().Add(-outboxKeepSent).Unix()
+	deadExpired := time.Now().Add(-outboxKeepDead).Unix()
+	for _, m := range ListOutbox("") {
+		if (m.Status == MailSent && m.SentAt < sentExpired) || (m.Status == MailDead && m.CreatedAt < deadExpired) {
+			outbox.Del(m.ID)
+		}
+	}
+}
+
+// DropMails drops the mails to email from the outbox, sent or not.
+func DropMails(email string) {
+	ids, _ := outbox.GetAll()
+	for _, id := range ids {
+		if to, _ := outbox.Get(id, "to"); to == email {
+			outboxPending.Del(id)
+			outbox.Del(id)
+		}
+	}
+}
+
+func RunOutbox() {
+	for {
+		DrainOutbox()
+		time.Sleep(outboxInterval)
+	}
+}
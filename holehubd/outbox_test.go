@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testMailer fails with err, or records the mails it sends.
+type testMailer struct {
+	err  error
+	sent []*Mail
+}
+
+func (m *testMailer) Send(mail *Mail) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+func TestOutboxSentMail(t *testing.T) {
+	openTestStore(t)
+	m := new(testMailer)
+	mailer = m
+
+	id := QueueMail(&Mail{To: "alice@example.com", Subject: "Reset", Text: "token 1234", HTML: "<b>1234</b>"})
+	DrainOutbox()
+	if len(m.sent) != 1 || m.sent[0].Text != "token 1234" {
+		t.Fatal("mails sent", m.sent)
+	}
+	if mail := GetOutboxMail(id); mail == nil || mail.Status != MailSent {
+		t.Fatal("sent mail is", mail)
+	}
+	for _, field := range []string{"text", "html"} {
+		if ok, _ := outbox.Has(id, field); ok {
+			t.Error("sent mail kept its", field)
+		}
+	}
+	if ResendMail(id) {
+		t.Error("sent mail resent without its body")
+	}
+
+	outbox.Set(id, "sent_at", strconv.FormatInt(time.Now().Add(-outboxKeepSent-time.Hour).Unix(), 10))
+	DrainOutbox()
+	if GetOutboxMail(id) != nil {
+		t.Error("expired sent mail kept")
+	}
+}
+
+func TestOutboxDeadMail(t *testing.T) {
+	openTestStore(t)
+	m := &testMailer{err: errors.New("provider down")}
+	mailer = m
+
+	id := QueueMail(&Mail{To: "alice@example.com", Subject: "Reset", Text: "token 1234"})
+	for i := 0; i < outboxMaxAttempts; i++ {
+		outbox.Set(id, "next_at", "0")
+		DrainOutbox()
+	}
+	if mail := GetOutboxMail(id); mail == nil || mail.Status != MailDead || mail.Attempts != outboxMaxAttempts {
+		t.Fatal("dead mail is", mail)
+	}
+
+	m.err = nil
+	if !ResendMail(id) {
+		t.Fatal("dead mail not resent")
+	}
+	DrainOutbox()
+	if len(m.sent) != 1 || m.sent[0].Text != "token 1234" {
+		t.Fatal("mails sent", m.sent)
+	}
+
+	dead := QueueMail(&Mail{To: "alice@example.com", Subject: "Reset"})
+	outbox.Set(dead, "status", MailDead)
+	outboxPending.Del(dead)
+	outbox.Set(dead, "created_at", strconv.FormatInt(time.Now().Add(-outboxKeepDead-time.Hour).Unix(), 10))
+	DrainOutbox()
+	if GetOutboxMail(dead) != nil {
+		t.Error("expired dead mail kept")
+	}
+}
+
+func TestDeleteAccountDropsMails(t *testing.T) {
+	openTestStore(t)
+	mailer = &testMailer{err: errors.New("provider down")}
+	userstate.AddUser("bob", "secret", "bob@example.com")
+
+	alice := QueueMail(&Mail{To: "alice@example.com", Subject: "Reset", Text: "token 1234"})
+	bob := QueueMail(&Mail{To: "bob@example.com", Subject: "Reset", Text: "token 5678"})
+	DeleteAccount("alice")
+	if GetOutboxMail(alice) != nil {
+		t.Error("mail of a deleted account kept")
+	}
+	if ok, _ := outboxPending.Has(alice); ok {
+		t.Error("mail of a deleted account still pending")
+	}
+	if GetOutboxMail(bob) == nil {
+		t.Error("mail of another account dropped")
+	}
+}
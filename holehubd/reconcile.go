@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// The reconciler brings config_dir in line with the store at start and then
+// every --reconcile_interval seconds: launch files of holes that no longer
+// exist are removed, so holed stops serving them, and every hole is driven
+// toward its desired state.
+var reconcileInterval int
+
+// Reconcile fixes config_dir and returns what it changed.
+func Reconcile() []string {
+	changes := make([]string, 0)
+	owners := holeOwners()
+	for _, holeID := range launchFiles() {
+		if _, ok := owners[holeID]; ok {
+			continue
+		}
+		if err := os.Remove(configPath + holeID + ".json"); err != nil {
+			log.Println("reconcile: remove launch file", holeID, "failed", err)
+			continue
+		}
+		log.Println("reconcile: removed orphaned launch file", holeID)
+		changes = append(changes, "removed orphaned launch file "+holeID)
+	}
+	return append(changes, DriveHoles()...)
+}
+
+func RunReconciler() {
+	for {
+		time.Sleep(time.Duration(reconcileInterval) * time.Second)
+		Reconcile()
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/xyproto/pinterface"
+	"strconv"
+	"strings"
+)
+
+// The SQL backend keeps the lists, sets, hash maps and key values of
+// holehubd in four tables shared by every store. The statements run
+// unchanged on SQLite 3.35+ and PostgreSQL 9.5+.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS holehub_lists (name TEXT NOT NULL, position BIGINT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (name, position))`,
+	`CREATE TABLE IF NOT EXISTS holehub_sets (name TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (name, value))`,
+	`CREATE TABLE IF NOT EXISTS holehub_hashmaps (name TEXT NOT NULL, owner TEXT NOT NULL, field TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (name, owner, field))`,
+	`CREATE TABLE IF NOT EXISTS holehub_keyvalues (name TEXT NOT NULL, field TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (name, field))`,
+}
+
+type SQLHost struct {
+	db     *sql.DB
+	driver string
+}
+
+func (h *SQLHost) Ping() error {
+	return h.db.Ping()
+}
+
+func (h *SQLHost) Close() {
+	h.db.Close()
+}
+
+// sqlTables lists the columns of the tables of sqlSchema.
+var sqlTables = map[string][]string{
+	"holehub_lists":     {"name", "position", "value"},
+	"holehub_sets":      {"name", "value"},
+	"holehub_hashmaps":  {"name", "owner", "field", "value"},
+	"holehub_keyvalues": {"name", "field", "value"},
+}
+
+// Snapshot writes the store as it is at one instant into a new SQLite file
+// while the writers go on. SQLite copies itself with VACUUM INTO,
+// PostgreSQL is read in a single repeatable read transaction.
+func (h *SQLHost) Snapshot(file string) error {
+	if h.driver == "sqlite3" {
+		_, err := h.db.Exec(`VACUUM INTO $1`, file)
+		return err
+	}
+	dst, err := sql.Open("sqlite3", file)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if _, err := NewSQLCreator(dst); err != nil {
+		return err
+	}
+	tx, err := h.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for table, columns := range sqlTables {
+		if err := copyTable(tx, dst, table, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTable copies the rows of table read in tx into dst.
+func copyTable(tx *sql.Tx, dst *sql.DB, table string, columns []string) error {
+	names := strings.Join(columns, ", ")
+	rows, err := tx.Query(`SELECT ` + names + ` FROM ` + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	marks := make([]string, len(columns))
+	for i := range marks {
+		marks[i] = "$" + strconv.Itoa(i+1)
+	}
+	insert := `INSERT INTO ` + table + ` (` + names + `) VALUES (` + strings.Join(marks, ", ") + `)`
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		if _, err := dst.Exec(insert, values...); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SQLCreator makes the pinterface data structures of the SQL backend.
+type SQLCreator struct {
+	db *sql.DB
+}
+
+func NewSQLCreator(db *sql.DB) (*SQLCreator, error) {
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLCreator{db}, nil
+}
+
+func (c *SQLCreator) NewList(id string) (pinterface.IList, error) {
+	return &SQLList{c.db, id}, nil
+}
+
+func (c *SQLCreator) NewSet(id string) (pinterface.ISet, error) {
+	return &SQLSet{c.db, id}, nil
+}
+
+func (c *SQLCreator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return &SQLHashMap{c.db, id}, nil
+}
+
+func (c *SQLCreator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return &SQLKeyValue{c.db, id}, nil
+}
+
+// queryStrings returns the first column of the rows of a query.
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// queryString returns the first column of the first row of a query, or an
+// empty string when there is none.
+func queryString(db *sql.DB, query string, args ...interface{}) (string, error) {
+	var value string
+	err := db.QueryRow(query, args...).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+type SQLList struct {
+	db   *sql.DB
+	name string
+}
+
+// Add appends value. Positions come from a counter in holehub_keyvalues,
+// the upsert hands out each one once even with several writers. A list
+// without a counter yet starts after its last position.
+func (l *SQLList) Add(value string) error {
+	var position int64
+	err := l.db.QueryRow(`INSERT INTO holehub_keyvalues (name, field, value) SELECT '_list_positions', $1, CAST(COALESCE(MAX(position), 0) + 1 AS TEXT) FROM holehub_lists WHERE name = $1 ON CONFLICT (name, field) DO UPDATE SET value = CAST(CAST(holehub_keyvalues.value AS BIGINT) + 1 AS TEXT) RETURNING CAST(value AS BIGINT)`, l.name).Scan(&position)
+	if err != nil {
+		return err
+	}
+	_, err = l.db.Exec(`INSERT INTO holehub_lists (name, position, value) VALUES ($1, $2, $3)`, l.name, position, value)
+	return err
+}
+
+func (l *SQLList) GetAll() ([]string, error) {
+	return queryStrings(l.db, `SELECT value FROM holehub_lists WHERE name = $1 ORDER BY position`, l.name)
+}
+
+func (l *SQLList) GetLast() (string, error) {
+	return queryString(l.db, `SELECT value FROM holehub_lists WHERE name = $1 ORDER BY position DESC LIMIT 1`, l.name)
+}
+
+func (l *SQLList) GetLastN(n int) ([]string, error) {
+	values, err := queryStrings(l.db, `SELECT value FROM holehub_lists WHERE name = $1 ORDER BY position DESC LIMIT $2`, l.name, n)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+	return values, nil
+}
+
+func (l *SQLList) Remove() error {
+	_, err := l.db.Exec(`DELETE FROM holehub_lists WHERE name = $1`, l.name)
+	return err
+}
+
+func (l *SQLList) Clear() error {
+	return l.Remove()
+}
+
+type SQLSet struct {
+	db   *sql.DB
+	name string
+}
+
+func (s *SQLSet) Add(value string) error {
+	_, err := s.db.Exec(`INSERT INTO holehub_sets (name, value) VALUES ($1, $2) ON CONFLICT (name, value) DO NOTHING`, s.name, value)
+	return err
+}
+
+func (s *SQLSet) Has(value string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM holehub_sets WHERE name = $1 AND value = $2`, s.name, value).Scan(&n)
+	return n > 0, err
+}
+
+func (s *SQLSet) GetAll() ([]string, error) {
+	return queryStrings(s.db, `SELECT value FROM holehub_sets WHERE name = $1 ORDER BY value`, s.name)
+}
+
+func (s *SQLSet) Del(value string) error {
+	_, err := s.db.Exec(`DELETE FROM holehub_sets WHERE name = $1 AND value = $2`, s.name, value)
+	return err
+}
+
+func (s *SQLSet) Remove() error {
+	_, err := s.db.Exec(`DELETE FROM holehub_sets WHERE name = $1`, s.name)
+	return err
+}
+
+func (s *SQLSet) Clear() error {
+	return s.Remove()
+}
+
+type SQLHashMap struct {
+	db   *sql.DB
+	name string
+}
+
+func (h *SQLHashMap) Set(owner, key, value string) error {
+	_, err := h.db.Exec(`INSERT INTO holehub_hashmaps (name, owner, field, value) VALUES ($1, $2, $3, $4) ON CONFLICT (name, owner, field) DO UPDATE SET value = excluded.value`, h.name, owner, key, value)
+	return err
+}
+
+func (h *SQLHashMap) Get(owner, key string) (string, error) {
+	return queryString(h.db, `SELECT value FROM holehub_hashmaps WHERE name = $1 AND owner = $2 AND field = $3`, h.name, owner, key)
+}
+
+func (h *SQLHashMap) Has(owner, key string) (bool, error) {
+	var n int
+	err := h.db.QueryRow(`SELECT COUNT(*) FROM holehub_hashmaps WHERE name = $1 AND owner = $2 AND field = $3`, h.name, owner, key).Scan(&n)
+	return n > 0, err
+}
+
+func (h *SQLHashMap) Exists(owner string) (bool, error) {
+	var n int
+	err := h.db.QueryRow(`SELECT COUNT(*) FROM holehub_hashmaps WHERE name = $1 AND owner = $2`, h.name, owner).Scan(&n)
+	return n > 0, err
+}
+
+func (h *SQLHashMap) GetAll() ([]string, error) {
+	return queryStrings(h.db, `SELECT DISTINCT owner FROM holehub_hashmaps WHERE name = $1 ORDER BY owner`, h.name)
+}
+
+// Keys returns the fields set for owner.
+func (h *SQLHashMap) Keys(owner string) ([]string, error) {
+	return queryStrings(h.db, `SELECT field FROM holehub_hashmaps WHERE name = $1 AND owner = $2 ORDER BY field`, h.name, owner)
+}
+
+func (h *SQLHashMap) DelKey(owner, key string) error {
+	_, err := h.db.Exec(`DELETE FROM holehub_hashmaps WHERE name = $1 AND owner = $2 AND field = $3`, h.name, owner, key)
+	return err
+}
+
+func (h *SQLHashMap) Del(owner string) error {
+	_, err := h.db.Exec(`DELETE FROM holehub_hashmaps WHERE name = $1 AND owner = $2`, h.name, owner)
+	return err
+}
+
+func (h *SQLHashMap) Remove() error {
+	_, err := h.db.Exec(`DELETE FROM holehub_hashmaps WHERE name = $1`, h.name)
+	return err
+}
+
+func (h *SQLHashMap) Clear() error {
+	return h.Remove()
+}
+
+type SQLKeyValue struct {
+	db   *sql.DB
+	name string
+}
+
+func (kv *SQLKeyValue) Set(key, value string) error {
+	_, err := kv.db.Exec(`INSERT INTO holehub_keyvalues (name, field, value) VALUES ($1, $2, $3) ON CONFLICT (name, field) DO UPDATE SET value = excluded.value`, kv.name, key, value)
+	return err
+}
+
+func (kv *SQLKeyValue) Get(key string) (string, error) {
+	return queryString(kv.db, `SELECT value FROM holehub_keyvalues WHERE name = $1 AND field = $2`, kv.name, key)
+}
+
+func (kv *SQLKeyValue) Del(key string) error {
+	_, err := kv.db.Exec(`DELETE FROM holehub_keyvalues WHERE name = $1 AND field = $2`, kv.name, key)
+	return err
+}
+
+// Inc adds one to the number kept at key in a single statement, so
+// several holehubd instances never get the same value.
+func (kv *SQLKeyValue) Inc(key string) (string, error) {
+	var value int64
+	err := kv.db.QueryRow(`INSERT INTO holehub_keyvalues (name, field, value) VALUES ($1, $2, '1') ON CONFLICT (name, field) DO UPDATE SET value = CAST(CAST(holehub_keyvalues.value AS BIGINT) + 1 AS TEXT) RETURNING CAST(value AS BIGINT)`, kv.name, key).Scan(&value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(value, 10), nil
+}
+
+func (kv *SQLKeyValue) Remove() error {
+	_, err := kv.db.Exec(`DELETE FROM holehub_keyvalues WHERE name = $1`, kv.name)
+	return err
+}
+
+func (kv *SQLKeyValue) Clear() error {
+	return kv.Remove()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/xyproto/pinterface"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLUserState keeps the accounts of the SQL backend with the same fields
+// permissionbolt uses, so db copy can move them over as they are.
+type SQLUserState struct {
+	users       pinterface.IHashMap
+	usernames   pinterface.ISet
+	unconfirmed pinterface.ISet
+	settings    pinterface.IKeyValue
+	host        *SQLHost
+	creator     *SQLCreator
+
+	cookieTime        int64
+	passwordAlgo      string
+	minCodeLength     int
+	cookieSecretCache string
+}
+
+const usernameCookie = "user"
+
+var confirmationCodeLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func NewSQLUserState(host *SQLHost, creator *SQLCreator) *SQLUserState {
+	state := &SQLUserState{
+		host:          host,
+		creator:       creator,
+		cookieTime:    3600 * 24,
+		passwordAlgo:  "bcrypt+",
+		minCodeLength: 20,
+	}
+	state.users, _ = creator.NewHashMap("users")
+	state.usernames, _ = creator.NewSet("usernames")
+	state.unconfirmed, _ = creator.NewSet("unconfirmed")
+	state.settings, _ = creator.NewKeyValue("settings")
+	return state
+}
+
+func (state *SQLUserState) UserRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	return err == nil && state.IsLoggedIn(username)
+}
+
+func (state *SQLUserState) HasUser(username string) bool {
+	ok, _ := state.usernames.Has(username)
+	return ok
+}
+
+func (state *SQLUserState) BooleanField(username, fieldname string) bool {
+	value, _ := state.users.Get(username, fieldname)
+	return value == "true"
+}
+
+func (state *SQLUserState) SetBooleanField(username, fieldname string, val bool) {
+	state.users.Set(username, fieldname, strconv.FormatBool(val))
+}
+
+func (state *SQLUserState) IsConfirmed(username string) bool {
+	return state.BooleanField(username, "confirmed")
+}
+
+func (state *SQLUserState) IsLoggedIn(username string) bool {
+	return state.HasUser(username) && state.BooleanField(username, "loggedin")
+}
+
+func (state *SQLUserState) AdminRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	return err == nil && state.IsLoggedIn(username) && state.IsAdmin(username)
+}
+
+func (state *SQLUserState) IsAdmin(username string) bool {
+	return state.BooleanField(username, "admin")
+}
+
+func (state *SQLUserState) signCookie(value string) string {
+	mac := hmac.New(sha256.New, []byte(state.CookieSecret()))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// UsernameCookie returns the user of the signed cookie of the request.
+func (state *SQLUserState) UsernameCookie(req *http.Request) (string, error) {
+	cookie, err := req.Cookie(usernameCookie)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(cookie.Value, "|")
+	if len(parts) != 3 || !hmac.Equal([]byte(state.signCookie(parts[0]+"|"+parts[1])), []byte(parts[2])) {
+		return "", errors.New("Invalid username cookie")
+	}
+	expiredAt, _ := strconv.ParseInt(parts[1], 10, 64)
+	if time.Now().Unix() > expiredAt {
+		return "", errors.New("Expired username cookie")
+	}
+	name, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	username := string(name)
+	if !state.HasUser(username) {
+		return "", errors.New("No such user")
+	}
+	return username, nil
+}
+
+func (state *SQLUserState) SetUsernameCookie(w http.ResponseWriter, username string) error {
+	if username == "" || !state.HasUser(username) {
+		return errors.New("Can't set cookie for an unknown user")
+	}
+	expiredAt := time.Now().Add(time.Duration(state.cookieTime) * time.Second)
+	value := base64.URLEncoding.EncodeToString([]byte(username)) + "|" + strconv.FormatInt(expiredAt.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     usernameCookie,
+		Value:    value + "|" + state.signCookie(value),
+		Path:     "/",
+		Expires:  expiredAt,
+		HttpOnly: true,
+	})
+	return nil
+}
+
+func (state *SQLUserState) AllUsernames() ([]string, error) {
+	return state.usernames.GetAll()
+}
+
+func (state *SQLUserState) Email(username string) (string, error) {
+	return state.users.Get(username, "email")
+}
+
+func (state *SQLUserState) PasswordHash(username string) (string, error) {
+	return state.users.Get(username, "password")
+}
+
+func (state *SQLUserState) AllUnconfirmedUsernames() ([]string, error) {
+	return state.unconfirmed.GetAll()
+}
+
+func (state *SQLUserState) ConfirmationCode(username string) (string, error) {
+	return state.users.Get(username, "confirmationCode")
+}
+
+func (state *SQLUserState) AddUnconfirmed(username, confirmationCode string) {
+	state.unconfirmed.Add(username)
+	state.users.Set(username, "confirmationCode", confirmationCode)
+}
+
+func (state *SQLUserState) RemoveUnconfirmed(username string) {
+	state.unconfirmed.Del(username)
+	state.users.DelKey(username, "confirmationCode")
+}
+
+func (state *SQLUserState) MarkConfirmed(username string) {
+	state.SetBooleanField(username, "confirmed", true)
+}
+
+func (state *SQLUserState) RemoveUser(username string) {
+	state.usernames.Del(username)
+	state.users.Del(username)
+}
+
+func (state *SQLUserState) SetAdminStatus(username string) {
+	state.SetBooleanField(username, "admin", true)
+}
+
+func (state *SQLUserState) RemoveAdminStatus(username string) {
+	state.SetBooleanField(username, "admin", false)
+}
+
+// addUserHash adds a user with an already hashed password.
+func (state *SQLUserState) addUserHash(username, passwordHash, email string) {
+	state.usernames.Add(username)
+	state.users.Set(username, "password", passwordHash)
+	state.users.Set(username, "email", email)
+	state.SetBooleanField(username, "confirmed", false)
+	state.SetBooleanField(username, "loggedin", false)
+	state.SetBooleanField(username, "admin", false)
+}
+
+func (state *SQLUserState) AddUser(username, password, email string) {
+	state.addUserHash(username, state.HashPassword(username, password), email)
+}
+
+func (state *SQLUserState) SetLoggedIn(username string) {
+	state.SetBooleanField(username, "loggedin", true)
+}
+
+func (state *SQLUserState) SetLoggedOut(username string) {
+	state.SetBooleanField(username, "loggedin", false)
+}
+
+func (state *SQLUserState) Login(w http.ResponseWriter, username string) error {
+	state.SetLoggedIn(username)
+	return state.SetUsernameCookie(w, username)
+}
+
+func (state *SQLUserState) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    usernameCookie,
+		Value:   "",
+		Path:    "/",
+		Expires: time.Unix(0, 0),
+		MaxAge:  -1,
+	})
+}
+
+func (state *SQLUserState) Logout(username string) {
+	state.SetLoggedOut(username)
+}
+
+func (state *SQLUserState) Username(req *http.Request) string {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return ""
+	}
+	return username
+}
+
+func (state *SQLUserState) CookieTimeout(username string) int64 {
+	return state.cookieTime
+}
+
+func (state *SQLUserState) SetCookieTimeout(cookieTime int64) {
+	state.cookieTime = cookieTime
+}
+
+// CookieSecret is kept in the database, so every holehubd instance signs
+// and accepts the same cookies.
+func (state *SQLUserState) CookieSecret() string {
+	if state.cookieSecretCache != "" {
+		return state.cookieSecretCache
+	}
+	secret, _ := state.settings.Get("cookie_secret")
+	if secret == "" {
+		secret = randomString(32)
+		state.settings.Set("cookie_secret", secret)
+	}
+	state.cookieSecretCache = secret
+	return secret
+}
+
+func (state *SQLUserState) SetCookieSecret(cookieSecret string) {
+	state.settings.Set("cookie_secret", cookieSecret)
+	state.cookieSecretCache = cookieSecret
+}
+
+func (state *SQLUserState) PasswordAlgo() string {
+	return state.passwordAlgo
+}
+
+func (state *SQLUserState) SetPasswordAlgo(algorithm string) error {
+	switch algorithm {
+	case "sha256", "bcrypt", "bcrypt+":
+		state.passwordAlgo = algorithm
+		return nil
+	}
+	return errors.New("Permissions: " + algorithm + " is an unsupported encryption algorithm")
+}
+
+func (state *SQLUserState) hashSha256(username, password string) string {
+	sum := sha256.Sum256([]byte(state.CookieSecret() + password + username))
+	return hex.EncodeToString(sum[:])
+}
+
+func (state *SQLUserState) HashPassword(username, password string) string {
+	if state.passwordAlgo == "sha256" {
+		return state.hashSha256(username, password)
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash)
+}
+
+func (state *SQLUserState) SetPassword(username, password string) {
+	state.users.Set(username, "password", state.HashPassword(username, password))
+}
+
+// CorrectPassword checks bcrypt hashes, and sha256 hashes unless the
+// algorithm is bcrypt only.
+func (state *SQLUserState) CorrectPassword(username, password string) bool {
+	hash, err := state.PasswordHash(username)
+	if err != nil || hash == "" {
+		return false
+	}
+	if strings.HasPrefix(hash, "$2") {
+		return state.passwordAlgo != "sha256" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	if state.passwordAlgo == "bcrypt" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(state.hashSha256(username, password))) == 1
+}
+
+func (state *SQLUserState) FindUserByConfirmationCode(confirmationcode string) (string, error) {
+	usernames, err := state.AllUnconfirmedUsernames()
+	if err != nil {
+		return "", err
+	}
+	for _, username := range usernames {
+		if code, _ := state.ConfirmationCode(username); code == confirmationcode {
+			return username, nil
+		}
+	}
+	return "", errors.New("No such confirmation code")
+}
+
+func (state *SQLUserState) AlreadyHasConfirmationCode(confirmationCode string) bool {
+	_, err := state.FindUserByConfirmationCode(confirmationCode)
+	return err == nil
+}
+
+func (state *SQLUserState) Confirm(username string) {
+	state.RemoveUnconfirmed(username)
+	state.MarkConfirmed(username)
+}
+
+func (state *SQLUserState) ConfirmUserByConfirmationCode(confirmationcode string) error {
+	username, err := state.FindUserByConfirmationCode(confirmationcode)
+	if err != nil {
+		return err
+	}
+	state.Confirm(username)
+	return nil
+}
+
+func (state *SQLUserState) SetMinimumConfirmationCodeLength(length int) {
+	state.minCodeLength = length
+}
+
+func randomString(length int) string {
+	b := make([]byte, length)
+	rand.Read(b)
+	for i := range b {
+		b[i] = confirmationCodeLetters[int(b[i])%len(confirmationCodeLetters)]
+	}
+	return string(b)
+}
+
+func (state *SQLUserState) GenerateUniqueConfirmationCode() (string, error) {
+	for i := 0; i < 100; i++ {
+		code := randomString(state.minCodeLength)
+		if !state.AlreadyHasConfirmationCode(code) {
+			return code, nil
+		}
+	}
+	return "", errors.New("Permissions: could not generate a unique confirmation code")
+}
+
+func (state *SQLUserState) Users() pinterface.IHashMap {
+	return state.users
+}
+
+func (state *SQLUserState) Host() pinterface.IHost {
+	return state.host
+}
+
+func (state *SQLUserState) Creator() pinterface.ICreator {
+	return state.creator
+}
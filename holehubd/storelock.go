@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/xyproto/pinterface"
+	"log"
+	"sync"
+)
+
+// A StoreLocker serializes the read-modify-writes of the store, like
+// taking a port or appending to the audit chain, between everything that
+// shares the store. Locks are named; holding one does not block the others.
+type StoreLocker interface {
+	Lock(name string) (unlock func())
+}
+
+var storeLocks StoreLocker = newLocalLocks()
+
+// lockStore takes the store lock called name and returns its unlock.
+func lockStore(name string) func() {
+	return storeLocks.Lock(name)
+}
+
+// NewStoreLocker returns the locks for the store of host. bolt and SQLite
+// serve a single holehubd, so process locks are enough. PostgreSQL may be
+// shared and uses advisory locks.
+func NewStoreLocker(host pinterface.IHost) StoreLocker {
+	if sqlHost, ok := host.(*SQLHost); ok && sqlHost.driver == "postgres" {
+		return &pgLocks{local: newLocalLocks(), db: sqlHost.db}
+	}
+	return newLocalLocks()
+}
+
+type namedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// localLocks are process locks, dropped once nobody holds or waits on them.
+type localLocks struct {
+	lock  sync.Mutex
+	locks map[string]*namedLock
+}
+
+func newLocalLocks() *localLocks {
+	return &localLocks{locks: make(map[string]*namedLock)}
+}
+
+func (l *localLocks) Lock(name string) func() {
+	l.lock.Lock()
+	nl, ok := l.locks[name]
+	if !ok {
+		nl = new(namedLock)
+		l.locks[name] = nl
+	}
+	nl.refs++
+	l.lock.Unlock()
+
+	nl.Lock()
+	return func() {
+		nl.Unlock()
+		l.lock.Lock()
+		nl.refs--
+		if nl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.lock.Unlock()
+	}
+}
+
+// pgLocks take a PostgreSQL session advisory lock keyed by the name on a
+// connection of their own. The process lock in front keeps it to one
+// connection per name and instance. Every lock held takes a connection of
+// the pool and locks nest up to three deep (quota, hole, holes), so a
+// writer may hold four connections: a capped pool must allow that many per
+// concurrent request or the writers wait on each other forever.
+type pgLocks struct {
+	local *localLocks
+	db    *sql.DB
+}
+
+const pgLockKey = `('x' || substr(md5($1), 1, 16))::bit(64)::bigint`
+
+func (l *pgLocks) Lock(name string) func() {
+	unlock := l.local.Lock(name)
+	ctx := context.Background()
+	conn, err := l.db.Conn(ctx)
+	if err == nil {
+		if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock(`+pgLockKey+`)`, name); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		// The store is unreachable, the writes under the lock fail too.
+		log.Println("store lock", name, "failed", err)
+		return unlock
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock(`+pgLockKey+`)`, name); err != nil {
+			// Close would hand the session back to the pool with the lock
+			// still held. Discard it instead, ending the session releases
+			// its advisory locks.
+			log.Println("store unlock", name, "failed", err)
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+		unlock()
+	}
+}
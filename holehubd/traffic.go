@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"github.com/xyproto/pinterface"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The hole server reports the traffic of every hole to holehubd, which
+// rolls the samples up into minute, hour and day buckets. Reports are
+// authenticated with --report_token.
+var reportToken string
+
+// holeStats keeps one record per hole, step and bucket, keyed
+// <holeID>:<step>:<bucket start>.
+var holeStats pinterface.IHashMap
+
+var statsInterval = time.Hour
+
+type statsStep struct {
+	Name      string
+	Size      int64
+	Retention time.Duration
+}
+
+var statsSteps = []statsStep{
+	{"minute", 60, 24 * time.Hour},
+	{"hour", 3600, 30 * 24 * time.Hour},
+	{"day", 86400, 365 * 24 * time.Hour},
+}
+
+var statsFields = []string{"bytes_in", "bytes_out", "connections", "duration"}
+
+type TrafficSample struct {
+	BytesIn     int64
+	BytesOut    int64
+	Connections int64
+	Duration    int64
+	Open        int64
+}
+
+type StatsBucket struct {
+	Time        int64 `json:"time"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+	Connections int64 `json:"connections"`
+	Duration    int64 `json:"duration"`
+}
+
+var openConnections = struct {
+	sync.Mutex
+	holes map[string]int64
+}{holes: make(map[string]int64)}
+
+// forgetOpenConnections drops the open connection count of a removed hole.
+func forgetOpenConnections(holeID string) {
+	openConnections.Lock()
+	delete(openConnections.holes, holeID)
+	openConnections.Unlock()
+}
+
+func findStatsStep(name string) (statsStep, bool) {
+	for _, step := range statsSteps {
+		if step.Name == name {
+			return step, true
+		}
+	}
+	return statsStep{}, false
+}
+
+func statsKey(holeID string, step statsStep, t int64) string {
+	return holeID + ":" + step.Name + ":" + strconv.FormatInt(t-t%step.Size, 10)
+}
+
+func getStatsField(key, field string) int64 {
+	value, _ := holeStats.Get(key, field)
+	i, _ := strconv.ParseInt(value, 10, 64)
+	return i
+}
+
+// HoleOwner returns the owner of a hole.
+func HoleOwner(holeID string) string {
+	owner, _ := usershole.holes.Get(holeID, "owner")
+	return owner
+}
+
+// RecordTraffic adds a sample reported for the hole to its buckets, to the
+// transfer and connection usage of the owner and to the metrics.
+func RecordTraffic(holeID string, sample TrafficSample) {
+	now := time.Now().Unix()
+	values := []int64{sample.BytesIn, sample.BytesOut, sample.Connections, sample.Duration}
+	unlock := lockStore("stats:" + holeID)
+	for _, step := range statsSteps {
+		key := statsKey(holeID, step, now)
+		for i, field := range statsFields {
+			if values[i] == 0 {
+				continue
+			}
+			holeStats.Set(key, field, strconv.FormatInt(getStatsField(key, field)+values[i], 10))
+		}
+	}
+	unlock()
+
+	holeBytes.Add(float64(sample.BytesIn), "in")
+	holeBytes.Add(float64(sample.BytesOut), "out")
+	countHoleBytes(holeID, sample.BytesIn, sample.BytesOut)
+	PublishHoleEvent(EventMetrics, holeID, map[string]interface{}{
+		"bytes_in":    sample.BytesIn,
+		"bytes_out":   sample.BytesOut,
+		"connections": sample.Connections,
+		"open":        sample.Open,
+	})
+
+	account := accountOf(HoleOwner(holeID))
+	if account == "" {
+		return
+	}
+	transfer := AddTransfer(account, sample.BytesIn, sample.BytesOut)
+
+	openConnections.Lock()
+	openConnections.holes[holeID] = sample.Open
+	openConnections.Unlock()
+	open := accountConnections(account)
+	SetConnections(account, open)
+
+	limits := EffectiveLimits(account)
+	if limit, ok := limits["transfer"]; ok && transfer > limit {
+		killOverLimit(account, holeID, "transfer")
+	} else if limit, ok := limits["connections"]; ok && open > limit {
+		killOverLimit(account, holeID, "connections")
+	}
+}
+
+// accountConnections sums the open connections last reported for the holes
+// that count against account.
+func accountConnections(account string) int64 {
+	var open int64
+	for _, owner := range accountOwners(account) {
+		for _, holeID := range usershole.HoleIDs(owner) {
+			openConnections.Lock()
+			open += openConnections.holes[holeID]
+			openConnections.Unlock()
+		}
+	}
+	return open
+}
+
+// killOverLimit kills the hole that took account over its limit called
+// name. Starting it again is refused until the usage is back under.
+func killOverLimit(account, holeID, name string) {
+	hs := usershole.GetOne(HoleOwner(holeID), holeID)
+	if hs == nil {
+		return
+	}
+	log.Println("hole", holeID, "of", account, "is over the", name, "limit, kill it")
+	hs.Kill()
+	forgetOpenConnections(holeID)
+	SetConnections(account, accountConnections(account))
+	Audit("holehubd", "quota.kill", holeID, nil)
+}
+
+// maxStatsBuckets bounds the store lookups of a single stats query.
+const maxStatsBuckets = 1500
+
+// clampStatsRange limits from and to to the buckets step keeps, at most
+// maxStatsBuckets of them ending at to.
+func clampStatsRange(step statsStep, from, to int64) (int64, int64) {
+	now := time.Now().Unix()
+	if oldest := now - int64(step.Retention/time.Second); from < oldest {
+		from = oldest
+	}
+	if to > now {
+		to = now
+	}
+	if to-from >= maxStatsBuckets*step.Size {
+		from = to - (maxStatsBuckets-1)*step.Size
+	}
+	return from, to
+}
+
+// HoleStats returns the buckets of step between from and to.
+func HoleStats(holeID string, step statsStep, from, to int64) []StatsBucket {
+	buckets := make([]StatsBucket, 0)
+	from, to = clampStatsRange(step, from, to)
+	for t := from - from%step.Size; t <= to; t += step.Size {
+		key := statsKey(holeID, step, t)
+		if ok, _ := holeStats.Exists(key); !ok {
+			continue
+		}
+		buckets = append(buckets, StatsBucket{
+			Time:        t,
+			BytesIn:     getStatsField(key, "bytes_in"),
+			BytesOut:    getStatsField(key, "bytes_out"),
+			Connections: getStatsField(key, "connections"),
+			Duration:    getStatsField(key, "duration"),
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Time < buckets[j].Time })
+	return buckets
+}
+
+// PruneStats drops buckets older than the retention of their step, and the
+// buckets of holes that no longer exist.
+func PruneStats() {
+	now := time.Now()
+	keys, _ := holeStats.GetAll()
+	for _, key := range keys {
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		step, ok := findStatsStep(parts[1])
+		t, err := strconv.ParseInt(parts[2], 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		exists, _ := usershole.holes.Exists(parts[0])
+		if !exists || t < now.Add(-step.Retention).Unix() {
+			holeStats.Del(key)
+		}
+	}
+}
+
+func RunStatsPruner() {
+	for {
+		PruneStats()
+		time.Sleep(statsInterval)
+	}
+}
+
+// reportAllowed checks the token of a hole server report.
+func reportAllowed(req *http.Request) bool {
+	return tokenEqual(req.Header.Get("X-Report-Token"), reportToken)
+}
+
+// tokenEqual tells whether the token sent is the configured one, in
+// constant time. An empty configured token allows nobody.
+func tokenEqual(sent, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+func formInt(req *http.Request, name string) int64 {
+	i, _ := strconv.ParseInt(req.Form.Get(name), 10, 64)
+	return i
+}
+
+// statsHandler answers the stats of the hole found by getHole.
+func statsHandler(r *render.Render, getHole func(req *http.Request) *HoleApp) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		hs := getHole(req)
+		if hs == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		req.ParseForm()
+		stepName := req.Form.Get("step")
+		if stepName == "" {
+			stepName = "hour"
+		}
+		step, ok := findStatsStep(stepName)
+		if !ok {
+			r.JSON(w, http.StatusOK, ErrorMessages[27])
+			return
+		}
+		to := formInt(req, "to")
+		if to == 0 {
+			to = time.Now().Unix()
+		}
+		from := formInt(req, "from")
+		if from == 0 {
+			from = to - 24*3600
+		}
+		if from > to {
+			r.JSON(w, http.StatusOK, ErrorMessages[39])
+			return
+		}
+		from, to = clampStatsRange(step, from, to)
+		r.JSON(w, http.StatusOK, map[string]interface{}{
+			"step":  step.Name,
+			"from":  from,
+			"to":    to,
+			"stats": HoleStats(hs.ID, step, from, to),
+		})
+	}
+}
+
+func TrafficRoutes(router *mux.Router, r *render.Render) {
+	router.HandleFunc("/api/holes/{holeID}/stats", statsHandler(r, func(req *http.Request) *HoleApp {
+		return usershole.GetOne(userstate.Username(req), mux.Vars(req)["holeID"])
+	})).Methods("GET")
+
+	router.HandleFunc("/api/orgs/{org}/holes/{holeID}/stats", statsHandler(r, func(req *http.Request) *HoleApp {
+		vars := mux.Vars(req)
+		if !HasOrgRole(vars["org"], userstate.Username(req), "viewer") {
+			return nil
+		}
+		return usershole.GetOne(OrgOwner(vars["org"]), vars["holeID"])
+	})).Methods("GET")
+
+	router.HandleFunc("/api/report/holes/{holeID}/traffic/", func(w http.ResponseWriter, req *http.Request) {
+		if !reportAllowed(req) {
+			http.Error(w, "Permission denied!", http.StatusForbidden)
+			return
+		}
+		holeID := mux.Vars(req)["holeID"]
+		if ok, _ := usershole.holes.Exists(holeID); !ok {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[10])
+			return
+		}
+		req.ParseForm()
+		RecordTraffic(holeID, TrafficSample{
+			BytesIn:     formInt(req, "bytes_in"),
+			BytesOut:    formInt(req, "bytes_out"),
+			Connections: formInt(req, "connections"),
+			Duration:    formInt(req, "duration"),
+			Open:        formInt(req, "open"),
+		})
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReportAllowed(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/report/holes/", nil)
+	reportToken = ""
+	if reportAllowed(req) {
+		t.Error("report allowed without a report token")
+	}
+	reportToken = "secret"
+	for token, allowed := range map[string]bool{"": false, "secre": false, "secret2": false, "secret": true} {
+		req.Header.Set("X-Report-Token", token)
+		if reportAllowed(req) != allowed {
+			t.Errorf("token %q allowed: %v, want %v", token, !allowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	"github.com/unrolled/render"
+	"github.com/xyproto/pinterface"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Webhooks POST the events of a user's holes and account to a URL of the
+// user, signed with HMAC-SHA256. Deliveries are queued in the store and
+// retried like the mail outbox.
+var webhooks pinterface.IHashMap
+var webhookDeliveries pinterface.IHashMap
+var webhookPending pinterface.ISet
+
+var webhookInterval = 10 * time.Second
+var webhookMaxAttempts = 10
+var webhookKeepDeliveries = 7 * 24 * time.Hour
+var webhookPrivate bool
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: webhookDialControl}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// webhookEvents are the event types a webhook can subscribe to.
+var webhookEvents = []string{EventStarted, EventKilled, EventCrashed, EventClientConnected, EventClientDisconnected, EventCertExpiring}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+type Webhook struct {
+	ID        string   `json:"id"`
+	Owner     string   `json:"owner"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt int64    `json:"createdAt"`
+}
+
+type WebhookDelivery struct {
+	ID           string `json:"id"`
+	Webhook      string `json:"webhook"`
+	Event        string `json:"event"`
+	Payload      string `json:"payload"`
+	Status       string `json:"status"`
+	Attempts     int    `json:"attempts"`
+	NextAt       int64  `json:"nextAt"`
+	CreatedAt    int64  `json:"createdAt"`
+	DeliveredAt  int64  `json:"deliveredAt"`
+	ResponseCode int    `json:"responseCode"`
+	LastError    string `json:"lastError"`
+}
+
+func GetWebhook(id string) *Webhook {
+	if ok, _ := webhooks.Exists(id); !ok || id == "" {
+		return nil
+	}
+	hook := &Webhook{ID: id}
+	hook.Owner, _ = webhooks.Get(id, "owner")
+	hook.URL, _ = webhooks.Get(id, "url")
+	hook.Secret, _ = webhooks.Get(id, "secret")
+	events, _ := webhooks.Get(id, "events")
+	hook.Events = splitList(events)
+	createdAt, _ := webhooks.Get(id, "created_at")
+	hook.CreatedAt, _ = strconv.ParseInt(createdAt, 10, 64)
+	return hook
+}
+
+// Webhooks returns the webhooks of username without their secrets.
+func Webhooks(username string) []*Webhook {
+	ids, _ := userstate.Users().Get(username, "webhooks")
+	hooks := make([]*Webhook, 0)
+	for _, id := range splitList(ids) {
+		if hook := GetWebhook(id); hook != nil {
+			hook.Secret = ""
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+func validWebhookEvent(name string) bool {
+	for _, event := range webhookEvents {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// publicIP tells if webhooks may reach ip, that is it is not a loopback,
+// private, link-local, multicast or unspecified address.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// webhookHostAllowed tells if every address of host is public, unless
+// --webhook_private is set.
+func webhookHostAllowed(host string) bool {
+	if webhookPrivate {
+		return true
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl refuses the connections of deliveries to addresses
+// that are not public, whatever the url resolves to by then or redirects
+// to.
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	if webhookPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("webhook: %s is not a public address", host)
+	}
+	return nil
+}
+
+// CreateWebhook stores a webhook of owner. A secret is generated when none
+// is given.
+func CreateWebhook(owner, hookURL string, events []string, secret string) (*Webhook, error) {
+	if secret == "" {
+		var err error
+		if secret, err = userstate.GenerateUniqueConfirmationCode(); err != nil {
+			return nil, err
+		}
+	}
+	hook := &Webhook{
+		ID:        uuid.NewV4().String(),
+		Owner:     owner,
+		URL:       hookURL,
+		Events:    events,
+		Secret:    secret,
+		CreatedAt: time.Now().Unix(),
+	}
+	var list string
+	for _, event := range events {
+		list = addToList(list, event)
+	}
+	webhooks.Set(hook.ID, "owner", hook.Owner)
+	webhooks.Set(hook.ID, "url", hook.URL)
+	webhooks.Set(hook.ID, "events", list)
+	webhooks.Set(hook.ID, "secret", hook.Secret)
+	webhooks.Set(hook.ID, "created_at", strconv.FormatInt(hook.CreatedAt, 10))
+	users := userstate.Users()
+	ids, _ := users.Get(owner, "webhooks")
+	users.Set(owner, "webhooks", addToList(ids, hook.ID))
+	return hook, nil
+}
+
+// DeleteWebhook removes the webhook and its delivery history.
+func DeleteWebhook(hook *Webhook) {
+	for _, d := range WebhookDeliveries(hook.ID) {
+		webhookDeliveries.Del(d.ID)
+		webhookPending.Del(d.ID)
+	}
+	webhooks.Del(hook.ID)
+	users := userstate.Users()
+	ids, _ := users.Get(hook.Owner, "webhooks")
+	users.Set(hook.Owner, "webhooks", removeFromList(ids, hook.ID))
+}
+
+// RemoveWebhooks removes every webhook of username.
+func RemoveWebhooks(username string) {
+	for _, hook := range Webhooks(username) {
+		DeleteWebhook(hook)
+	}
+}
+
+func getDeliveryInt(id, key string) int64 {
+	value, _ := webhookDeliveries.Get(id, key)
+	i, _ := strconv.ParseInt(value, 10, 64)
+	return i
+}
+
+func GetWebhookDelivery(id string) *WebhookDelivery {
+	if ok, _ := webhookDeliveries.Exists(id); !ok || id == "" {
+		return nil
+	}
+	d := &WebhookDelivery{ID: id}
+	d.Webhook, _ = webhookDeliveries.Get(id, "webhook")
+	d.Event, _ = webhookDeliveries.Get(id, "event")
+	d.Payload, _ = webhookDeliveries.Get(id, "payload")
+	d.Status, _ = webhookDeliveries.Get(id, "status")
+	d.LastError, _ = webhookDeliveries.Get(id, "last_error")
+	d.Attempts = int(getDeliveryInt(id, "attempts"))
+	d.NextAt = getDeliveryInt(id, "next_at")
+	d.CreatedAt = getDeliveryInt(id, "created_at")
+	d.DeliveredAt = getDeliveryInt(id, "delivered_at")
+	d.ResponseCode = int(getDeliveryInt(id, "response_code"))
+	return d
+}
+
+// WebhookDeliveries returns the delivery history of the webhook, newest
+// first.
+func WebhookDeliveries(webhookID string) []*WebhookDelivery {
+	ids, _ := webhookDeliveries.GetAll()
+	deliveries := make([]*WebhookDelivery, 0)
+	for _, id := range ids {
+		if hookID, _ := webhookDeliveries.Get(id, "webhook"); hookID != webhookID {
+			continue
+		}
+		if d := GetWebhookDelivery(id); d != nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt > deliveries[j].CreatedAt })
+	return deliveries
+}
+
+func queueDelivery(hook *Webhook, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("webhook", hook.ID, "encode event failed", err)
+		return
+	}
+	id := uuid.NewV4().String()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	webhookDeliveries.Set(id, "webhook", hook.ID)
+	webhookDeliveries.Set(id, "event", event.Type)
+	webhookDeliveries.Set(id, "payload", string(payload))
+	webhookDeliveries.Set(id, "status", DeliveryPending)
+	webhookDeliveries.Set(id, "attempts", "0")
+	webhookDeliveries.Set(id, "next_at", now)
+	webhookDeliveries.Set(id, "created_at", now)
+	webhookPending.Add(id)
+}
+
+// QueueWebhooks queues a delivery of event for every webhook subscribed to
+// it whose owner may see it.
+func QueueWebhooks(event Event) {
+	if !validWebhookEvent(event.Type) {
+		return
+	}
+	ids, _ := webhooks.GetAll()
+	for _, id := range ids {
+		hook := GetWebhook(id)
+		if hook == nil || !canSeeEvent(hook.Owner, event) {
+			continue
+		}
+		for _, name := range hook.Events {
+			if name == event.Type {
+				queueDelivery(hook, event)
+				break
+			}
+		}
+	}
+}
+
+// Redeliver puts a delivery back in the queue.
+func Redeliver(id string) bool {
+	if ok, _ := webhookDeliveries.Exists(id); !ok {
+		return false
+	}
+	webhookDeliveries.Set(id, "status", DeliveryPending)
+	webhookDeliveries.Set(id, "attempts", "0")
+	webhookDeliveries.Set(id, "next_at", strconv.FormatInt(time.Now().Unix(), 10))
+	webhookDeliveries.DelKey(id, "last_error")
+	webhookPending.Add(id)
+	return true
+}
+
+// signPayload returns the X-Holehub-Signature of payload.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(hook *Webhook, d *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "HoleHUB-Webhook")
+	req.Header.Set("X-Holehub-Event", d.Event)
+	req.Header.Set("X-Holehub-Delivery", d.ID)
+	req.Header.Set("X-Holehub-Signature", signPayload(hook.Secret, []byte(d.Payload)))
+	rsp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return rsp.StatusCode, fmt.Errorf("webhook: %s answered %s", hook.URL, rsp.Status)
+	}
+	return rsp.StatusCode, nil
+}
+
+func deliverWebhook(id string) {
+	d := GetWebhookDelivery(id)
+	if d == nil {
+		webhookPending.Del(id)
+		return
+	}
+	hook := GetWebhook(d.Webhook)
+	if hook == nil {
+		webhookDeliveries.Del(id)
+		webhookPending.Del(id)
+		return
+	}
+
+	now := time.Now()
+	code, err := postWebhook(hook, d)
+	webhookDeliveries.Set(id, "response_code", strconv.Itoa(code))
+	if err == nil {
+		webhookDeliveries.Set(id, "status", DeliveryDelivered)
+		webhookDeliveries.Set(id, "delivered_at", strconv.FormatInt(now.Unix(), 10))
+		webhookDeliveries.DelKey(id, "last_error")
+		webhookPending.Del(id)
+		return
+	}
+
+	attempts := d.Attempts + 1
+	log.Println("webhook", hook.ID, "delivery", id, "failed", attempts, "times", err)
+	webhookDeliveries.Set(id, "attempts", strconv.Itoa(attempts))
+	webhookDeliveries.Set(id, "last_error", err.Error())
+	if attempts >= webhookMaxAttempts {
+		webhookDeliveries.Set(id, "status", DeliveryDead)
+		webhookPending.Del(id)
+		return
+	}
+	webhookDeliveries.Set(id, "next_at", strconv.FormatInt(now.Add(outboxBackoff(attempts)).Unix(), 10))
+}
+
+// DrainWebhooks sends every pending delivery that is due and drops
+// delivered ones older than webhookKeepDeliveries.
+func DrainWebhooks() {
+	now := time.Now().Unix()
+	ids, _ := webhookPending.GetAll()
+	for _, id := range ids {
+		if getDeliveryInt(id, "next_at") > now {
+			continue
+		}
+		deliverWebhook(id)
+	}
+
+	expired := time.Now().Add(-webhookKeepDeliveries).Unix()
+	ids, _ = webhookDeliveries.GetAll()
+	for _, id := range ids {
+		status, _ := webhookDeliveries.Get(id, "status")
+		if status == DeliveryDelivered && getDeliveryInt(id, "delivered_at") < expired {
+			webhookDeliveries.Del(id)
+		}
+	}
+}
+
+// RunWebhooks delivers the pending deliveries every webhookInterval. Every
+// instance queues the deliveries of its own events as they are published,
+// only the workers deliver.
+func RunWebhooks() {
+	for {
+		time.Sleep(webhookInterval)
+		DrainWebhooks()
+	}
+}
+
+// ownWebhook returns the webhook of the request when it belongs to the user.
+func ownWebhook(req *http.Request) *Webhook {
+	hook := GetWebhook(mux.Vars(req)["webhookID"])
+	if hook == nil || hook.Owner != userstate.Username(req) {
+		return nil
+	}
+	return hook
+}
+
+func WebhookRoutes(router *mux.Router, r *render.Render) {
+	router.HandleFunc("/api/webhooks/", func(w http.ResponseWriter, req *http.Request) {
+		r.JSON(w, http.StatusOK, map[string][]*Webhook{"webhooks": Webhooks(userstate.Username(req))})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/webhooks/", func(w http.ResponseWriter, req *http.Request) {
+		username := userstate.Username(req)
+		req.ParseForm()
+		hookURL := req.Form.Get("url")
+		u, err := url.Parse(hookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			r.JSON(w, http.StatusOK, ErrorMessages[30])
+			return
+		}
+		if !webhookHostAllowed(u.Hostname()) {
+			r.JSON(w, http.StatusOK, ErrorMessages[40])
+			return
+		}
+		events := splitList(req.Form.Get("events"))
+		if len(events) == 0 {
+			events = webhookEvents
+		}
+		for _, event := range events {
+			if !validWebhookEvent(event) {
+				r.JSON(w, http.StatusOK, ErrorMessages[31])
+				return
+			}
+		}
+		hook, err := CreateWebhook(username, hookURL, events, req.Form.Get("secret"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Audit(username, "webhook.create", hook.ID, req)
+		r.JSON(w, http.StatusOK, map[string]*Webhook{"webhook": hook})
+	}).Methods("POST")
+
+	router.HandleFunc("/api/webhooks/{webhookID}", func(w http.ResponseWriter, req *http.Request) {
+		hook := ownWebhook(req)
+		if hook == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[29])
+			return
+		}
+		hook.Secret = ""
+		r.JSON(w, http.StatusOK, map[string]*Webhook{"webhook": hook})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/webhooks/{webhookID}", func(w http.ResponseWriter, req *http.Request) {
+		hook := ownWebhook(req)
+		if hook == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[29])
+			return
+		}
+		DeleteWebhook(hook)
+		Audit(hook.Owner, "webhook.delete", hook.ID, req)
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("DELETE")
+
+	router.HandleFunc("/api/webhooks/{webhookID}/deliveries/", func(w http.ResponseWriter, req *http.Request) {
+		hook := ownWebhook(req)
+		if hook == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[29])
+			return
+		}
+		r.JSON(w, http.StatusOK, map[string][]*WebhookDelivery{"deliveries": WebhookDeliveries(hook.ID)})
+	}).Methods("GET")
+
+	router.HandleFunc("/api/webhooks/{webhookID}/deliveries/{deliveryID}/redeliver/", func(w http.ResponseWriter, req *http.Request) {
+		hook := ownWebhook(req)
+		if hook == nil {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[29])
+			return
+		}
+		d := GetWebhookDelivery(mux.Vars(req)["deliveryID"])
+		if d == nil || d.Webhook != hook.ID || !Redeliver(d.ID) {
+			r.JSON(w, http.StatusNotFound, ErrorMessages[32])
+			return
+		}
+		r.JSON(w, http.StatusOK, ErrorMessages[0])
+	}).Methods("POST")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+	payload := []byte(`{"type":"started"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(payload)
+	if sig := signPayload("s3cret", payload); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatal("signature is", sig)
+	}
+	if signPayload("other", payload) == signPayload("s3cret", payload) {
+		t.Fatal("signature does not depend on the secret")
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	openTestStore(t)
+	webhookPrivate = true
+	defer func() { webhookPrivate = false }()
+
+	var body []byte
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+		header = req.Header
+	}))
+	defer ts.Close()
+
+	hook, err := CreateWebhook("alice", ts.URL, []string{EventStarted}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	QueueWebhooks(Event{Type: EventKilled, Hole: "hole1", Owner: "alice", Time: time.Now().Unix()})
+	QueueWebhooks(Event{Type: EventStarted, Hole: "hole1", Owner: "bob", Time: time.Now().Unix()})
+	if deliveries := WebhookDeliveries(hook.ID); len(deliveries) != 0 {
+		t.Fatal(len(deliveries), "deliveries of events not subscribed to or not seen")
+	}
+	QueueWebhooks(Event{Type: EventStarted, Hole: "hole1", Owner: "alice", Time: time.Now().Unix()})
+	deliveries := WebhookDeliveries(hook.ID)
+	if len(deliveries) != 1 {
+		t.Fatal(len(deliveries), "deliveries queued")
+	}
+
+	deliverWebhook(deliveries[0].ID)
+	d := GetWebhookDelivery(deliveries[0].ID)
+	if d.Status != DeliveryDelivered || d.ResponseCode != http.StatusOK {
+		t.Fatal("delivery is", d.Status, d.ResponseCode, d.LastError)
+	}
+	if string(body) != d.Payload {
+		t.Fatal("posted", string(body))
+	}
+	if sig := header.Get("X-Holehub-Signature"); sig != signPayload("s3cret", body) {
+		t.Fatal("signed as", sig)
+	}
+	if header.Get("X-Holehub-Event") != EventStarted || header.Get("X-Holehub-Delivery") != d.ID {
+		t.Fatal("headers are", header)
+	}
+}
+
+func TestDeliverWebhookRefusesPrivate(t *testing.T) {
+	openTestStore(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("delivered to a loopback address")
+	}))
+	defer ts.Close()
+
+	// The url was allowed when the webhook was created but now points to
+	// a loopback address.
+	hook, err := CreateWebhook("alice", ts.URL, []string{EventStarted}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	QueueWebhooks(Event{Type: EventStarted, Hole: "hole1", Owner: "alice", Time: time.Now().Unix()})
+	id := WebhookDeliveries(hook.ID)[0].ID
+	deliverWebhook(id)
+	if d := GetWebhookDelivery(id); d.Status != DeliveryPending || d.Attempts != 1 || d.LastError == "" {
+		t.Fatal("delivery is", d.Status, d.Attempts, d.LastError)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"fd00::1":         false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"224.0.0.1":       false,
+		"ff02::1":         false,
+		"0.0.0.0":         false,
+	} {
+		if publicIP(net.ParseIP(addr)) != public {
+			t.Error(addr, "public:", !public)
+		}
+	}
+}
+
+func TestWebhookHostAllowed(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "localhost", "10.0.0.1", "169.254.169.254", "nonexistent.invalid"} {
+		if webhookHostAllowed(host) {
+			t.Error(host, "allowed")
+		}
+	}
+	if !webhookHostAllowed("93.184.216.34") {
+		t.Error("public address refused")
+	}
+
+	webhookPrivate = true
+	defer func() { webhookPrivate = false }()
+	if !webhookHostAllowed("127.0.0.1") {
+		t.Error("loopback refused with webhook_private")
+	}
+}
+
+func TestWebhookDialControl(t *testing.T) {
+	for address, allowed := range map[string]bool{
+		"93.184.216.34:443": true,
+		"127.0.0.1:80":      false,
+		"[::1]:80":          false,
+		"192.168.1.1:8080":  false,
+		"localhost:80":      false,
+		"127.0.0.1":         false,
+	} {
+		if err := webhookDialControl("tcp", address, nil); (err == nil) != allowed {
+			t.Error(address, "allowed:", !allowed, err)
+		}
+	}
+
+	webhookPrivate = true
+	defer func() { webhookPrivate = false }()
+	if err := webhookDialControl("tcp", "127.0.0.1:80", nil); err != nil {
+		t.Error("loopback refused with webhook_private:", err)
+	}
+}